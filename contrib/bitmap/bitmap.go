@@ -2,6 +2,7 @@ package bitmap
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
@@ -15,31 +16,78 @@ import (
 	"github.com/pierrec/lz4/v4"
 )
 
+// Default geometry, see Options. fastSlotNum is the max number of fast slots and
+// maxSlotSize is the max slot size.
 const (
 	slotSize     = 1 << 14
 	slotNum      = 1 << 6
 	fastSlotNum  = 1 << 12
+	maxSlotSize  = 1 << 20
 	fastSlotSize = 1 << 8
 	fastSlotMask = 0xfffff000
 	bfHash       = 3
 
+	// Capcity is the capacity of ranges with the default geometry.
 	Capcity = slotSize * slotNum
 )
 
+const (
+	fmtLegacy    = 1
+	fmtLegacyLZ4 = 4
+	fmtFlag      = 0x40
+	fmtLZ4       = 0x80
+	fmtIndexed   = 0x20
+	fmtRevMask   = 0x1f
+
+	fmtRevision = 3
+)
+
 type Range struct {
 	mu         sync.RWMutex
 	mfmu       sync.Mutex
 	start, end int64
 	fastTable  *roaring.Bitmap
-	slots      [slotNum]*subMap
+	slots      []*subMap
+	mapping    *mmapFile
+
+	// Geometry, see Options.
+	slotSize, fastSlotSize int64
+	hashNum                int
+
+	// Incremental persistence state, see SaveIncremental.
+	segmu sync.Mutex
+	seg   segState
+
+	// Optional key index, see EnableKeyIndex.
+	idxmu sync.Mutex
+	index *keyIndex
+
+	// Keep values of entries added afterward, see EnableStoredValues.
+	storeValues bool
 }
 
+// New creates a range starting at start with the default geometry, see NewWithOptions.
 func New(start int64) *Range {
+	o, _ := Options{}.normalize()
+	return newRange(start, o)
+}
+
+// NewWithOptions creates a range with geometry o, see Options.
+func NewWithOptions(start int64, o Options) (*Range, error) {
+	o, err := o.normalize()
+	if err != nil {
+		return nil, err
+	}
+	return newRange(start, o), nil
+}
+
+func newRange(start int64, o Options) *Range {
 	d := &Range{
 		start:     start,
 		end:       -1,
 		fastTable: roaring.New(),
 	}
+	d.setOptions(o)
 	for i := range d.slots {
 		d.slots[i] = &subMap{}
 	}
@@ -63,6 +111,7 @@ func (b *Range) FirstKey() Key {
 		return Key{}
 	}
 	m := b.slots[0]
+	m.ensure()
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	return m.keys[0]
@@ -72,7 +121,8 @@ func (b *Range) LastKey() Key {
 	if b.end < 0 {
 		return Key{}
 	}
-	m := b.slots[b.end/slotSize]
+	m := b.slots[b.end/b.slotSize]
+	m.ensure()
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	return m.keys[len(m.keys)-1]
@@ -83,9 +133,54 @@ type subMap struct {
 	keys  []Key
 	spans []uint32
 	xfs   []byte
+	dead  *roaring.Bitmap
+
+	// Timestamps of entries, nil if none of them has one.
+	ts           []int64
+	tsMin, tsMax int64
+
+	// Stored values of entries, nil if none of them has any, see EnableStoredValues.
+	vals     []byte
+	valSpans []uint32
+
+	// Encoded block of indexed layout, see ensure. If raw is nil and rawSrc is
+	// not nil, the block will be read from rawSrc at rawOff.
+	raw     []byte
+	rawSrc  io.ReaderAt
+	rawOff  int64
+	rawLen  int
+	rawLZ4  bool
+	rawOnce sync.Once
+	rawErr  error
+	mapping *mmapFile
 }
 
 func (b *Range) Add(key Key, values []uint64) bool {
+	return b.AddAt(key, values, 0)
+}
+
+// AddAt adds key with values and its unix milli timestamp, 0 means unknown.
+func (b *Range) AddAt(key Key, values []uint64, ts int64) bool {
+	_, ok := b.add(key, values, ts)
+	return ok
+}
+
+// Upsert adds key like Add and tombstones its previous entries in the range, so
+// only the latest version can be returned.
+func (b *Range) Upsert(key Key, values []uint64) bool {
+	return b.UpsertAt(key, values, 0)
+}
+
+func (b *Range) UpsertAt(key Key, values []uint64, ts int64) bool {
+	off, ok := b.add(key, values, ts)
+	if ok {
+		b.deleteKey(key, off)
+	}
+	return ok
+}
+
+// add adds an entry and returns its offset.
+func (b *Range) add(key Key, values []uint64, ts int64) (int64, bool) {
 	values = simple.Uint64.Dedup(values)
 	if len(values) == 0 {
 		panic("empty values")
@@ -94,25 +189,54 @@ func (b *Range) Add(key Key, values []uint64) bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if b.end == slotSize*slotNum-1 {
-		return false
+	if b.end == b.Capacity()-1 {
+		return 0, false
 	}
 
 	b.end++
-	offset := uint32(b.end / fastSlotSize)
+	offset := uint32(b.end / b.fastSlotSize)
+	b.segmu.Lock()
 	for _, v := range values {
 		h := h16(uint32(v), b.start)
-		for i := 0; i < bfHash; i++ {
+		for i := 0; i < b.hashNum; i++ {
 			b.fastTable.Add(h[i]&fastSlotMask | offset)
+			b.seg.trackFast(h[i]&fastSlotMask | offset)
 		}
 	}
+	b.segmu.Unlock()
 
-	m := b.slots[b.end/slotSize]
+	var vals []byte
+	if b.storeValues {
+		vals = encodeValues(values)
+	}
+
+	m := b.slots[b.end/b.slotSize]
+	m.ensure()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	xf := xfNew(values)
+	m.append(key, xfNew(values), vals, ts)
+	if x := b.keyIndex(); x != nil {
+		x.add(key, b.end)
+	}
+	return b.end, true
+}
 
+func (m *subMap) append(key Key, xf, vals []byte, ts int64) {
+	if vals != nil && m.valSpans == nil {
+		m.valSpans = make([]uint32, len(m.keys), cap(m.keys))
+	}
+	if m.valSpans != nil {
+		m.vals = append(m.vals, vals...)
+		m.valSpans = append(m.valSpans, uint32(len(m.vals)))
+	}
+	if ts != 0 && m.ts == nil {
+		m.ts = make([]int64, len(m.keys), cap(m.keys))
+	}
+	if m.ts != nil {
+		m.ts = append(m.ts, ts)
+		m.updateTsBounds(ts, len(m.ts) == 1)
+	}
 	m.keys = append(m.keys, key)
 	m.xfs = append(m.xfs, xf...)
 	if len(m.spans) == 0 {
@@ -120,55 +244,84 @@ func (b *Range) Add(key Key, values []uint64) bool {
 	} else {
 		m.spans = append(m.spans, m.spans[len(m.spans)-1]+uint32(len(xf)))
 	}
-	return true
 }
 
 func (b *Range) Join(vs Values, start int64, desc bool, f func(KeyIdScore) bool) (jm JoinMetrics) {
+	return b.JoinContext(context.Background(), vs, start, desc, f)
+}
+
+// JoinContext is Join but stops scanning between slots once ctx is done, jm.Err
+// will be set to ctx.Err() and hits found so far have been passed to f.
+func (b *Range) JoinContext(ctx context.Context, vs Values, start int64, desc bool, f func(KeyIdScore) bool) (jm JoinMetrics) {
 	vs.Clean()
+	jm = b.JoinQueryContext(ctx, vs.Query(), start, desc, f)
+	jm.Values = vs
+	return jm
+}
+
+func (b *Range) JoinQuery(q *Query, start int64, desc bool, f func(KeyIdScore) bool) (jm JoinMetrics) {
+	return b.JoinQueryContext(context.Background(), q, start, desc, f)
+}
+
+func (b *Range) JoinQueryContext(ctx context.Context, q *Query, start int64, desc bool, f func(KeyIdScore) bool) (jm JoinMetrics) {
 	fastStart := time.Now()
-	fast := b.joinFast(&vs)
+	fast := b.joinFast(q)
 	jm.FastElapsed = time.Since(fastStart)
+	return b.joinQuery(ctx, q, fast, fastStart, start, desc, jm, f)
+}
+
+func (b *Range) joinQuery(ctx context.Context, q *Query, fast bitmap1024, fastStart time.Time, start int64, desc bool,
+	jm JoinMetrics, f func(KeyIdScore) bool) JoinMetrics {
 	jm.BaseStart = b.start
 	jm.Start = start
-	jm.Values = vs
+	jm.Query = q
 	jm.Desc = desc
+	jm.Slots = make([]SlotMetrics, len(b.slots))
+	if q != nil {
+		if jm.Err = q.validate(); jm.Err != nil {
+			return jm
+		}
+	}
 
 	if start == -1 {
 		start = b.end
 	} else {
 		start -= b.start
-		if start < 0 || start >= slotNum*slotSize {
-			return
+		if start < 0 || start >= b.Capacity() {
+			return jm
 		}
 	}
 
-	startSlot := int(start / slotSize)
+	startSlot := int(start / b.slotSize)
 
 	endSlot, endCmp, step := -1, 1, -1
 	if !desc {
-		endSlot, endCmp, step = slotNum, -1, 1
+		endSlot, endCmp, step = len(b.slots), -1, 1
 	}
 
 	for i := startSlot; icmp(int64(i), int64(endSlot)) == endCmp; i += step {
-		if fast[i] == 0 {
+		if n := int(b.slotSize / b.fastSlotSize); !fast.any(i*n, (i+1)*n) {
 			continue
 		}
+		if jm.Err = ctx.Err(); jm.Err != nil {
+			break
+		}
 
 		m := b.slots[i]
-		startOffset := start - int64(i*slotSize)
+		startOffset := start - int64(i)*b.slotSize
 		if startOffset >= int64(len(m.keys)) {
 			startOffset = int64(len(m.keys)) - 1
 		}
 		if startOffset < 0 {
 			startOffset = 0
 		}
-		if exit := m.join(vs, i, &fast, startOffset, desc, b.start, &jm, f); exit {
+		if exit := m.join(q, i, &fast, startOffset, desc, b, &jm, f); exit {
 			break
 		}
 	}
 
 	jm.Elapsed = time.Since(fastStart)
-	return
+	return jm
 }
 
 func (b *subMap) prevSpan(i int64) uint32 {
@@ -178,60 +331,68 @@ func (b *subMap) prevSpan(i int64) uint32 {
 	return b.spans[i-1]
 }
 
-func (b *subMap) join(v Values, hr int, fast *bitmap1024, end1 int64, desc bool,
-	baseStart int64, jm *JoinMetrics, f func(KeyIdScore) bool) bool {
+func (b *subMap) join(q *Query, hr int, fast *bitmap1024, end1 int64, desc bool,
+	r *Range, jm *JoinMetrics, f func(KeyIdScore) bool) bool {
+	start := time.Now()
+	if err := b.ensure(); err != nil {
+		jm.Slots[hr].Err = err
+		return false
+	}
+
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	start := time.Now()
 	exit := false
-	ms := v.majorScore()
+	var terms []uint64
+	if q.Explain {
+		q.walkScored(func(t *Query) { terms = append(terms, t.Term) })
+	}
+
+	if from, to, ok := q.timeBounds(); ok && b.tsMin > 0 && (b.tsMin > to || b.tsMax < from) {
+		jm.Slots[hr].Elapsed = time.Since(start)
+		return false
+	}
 
 	iend, cmp, step := int64(-1), 1, int64(-1)
 	if !desc {
 		iend, cmp, step = int64(len(b.keys)), -1, 1
 	}
 
-NEXT:
 	for i := end1; icmp(i, iend) == cmp; i += step {
-		if !fast.contains(uint16((hr*slotSize + int(i)) / fastSlotSize)) {
+		if !fast.contains(uint16((int64(hr)*r.slotSize + i) / r.fastSlotSize)) {
 			continue
 		}
-		jm.Slots[hr].Scans++
-		xf, vs := xfBuild(b.xfs[b.prevSpan(i):b.spans[i]])
-
-		oneof := true
-		for _, hs := range v.Oneof {
-			if oneof = xfContains(xf, vs, hs); oneof {
-				break
-			}
-		}
-		if !oneof {
+		if b.isDead(i) {
 			continue
 		}
+		jm.Slots[hr].Scans++
+		xf, vs := xfBuild(b.xfs[b.prevSpan(i):b.spans[i]])
 
-		s := 0
-		for _, hs := range v.Major {
-			if xfContains(xf, vs, hs) {
-				s++
-			}
-		}
-		if s < ms {
+		ts := b.timestamp(i)
+		ok, s := q.match(xf, vs, ts)
+		if !ok {
 			continue
 		}
 
-		for _, hs := range v.Exact {
-			if !xfContains(xf, vs, hs) {
-				continue NEXT
-			}
-		}
-
 		jm.Slots[hr].Hits++
-		if !f(KeyIdScore{
+		kis := KeyIdScore{
 			Key:   b.keys[i],
-			Id:    int64(hr*slotSize) + int64(i) + baseStart,
+			Id:    int64(hr)*r.slotSize + i + r.start,
 			Score: s,
-		}) {
+			Time:  ts,
+			Start: r.start,
+		}
+		if terms != nil {
+			stored := decodeValues(b.rawValues(i))
+			kis.Matched = matchedValues(stored, terms)
+			kis.Terms = explainTerms(terms, func(t uint64) bool {
+				if stored != nil {
+					return containsValue(stored, t)
+				}
+				return xfContains(xf, vs, t)
+			})
+		}
+		if !f(kis) {
 			exit = true
 			break
 		}
@@ -241,14 +402,56 @@ NEXT:
 	return exit
 }
 
+func (b *subMap) timestamp(i int64) int64 {
+	if b.ts == nil {
+		return 0
+	}
+	return b.ts[i]
+}
+
+// updateTsBounds updates the min and max timestamps of the slot. tsMin will be 0
+// if the slot contains any entry without timestamp.
+func (b *subMap) updateTsBounds(ts int64, first bool) {
+	if first || ts < b.tsMin {
+		b.tsMin = ts
+	}
+	if first || ts > b.tsMax {
+		b.tsMax = ts
+	}
+}
+
+func (b *subMap) isDead(i int64) bool {
+	return b.dead != nil && b.dead.Contains(uint32(i))
+}
+
+func (b *subMap) deadCount(lo, hi int64) int64 {
+	if b.dead == nil {
+		return 0
+	}
+	c := b.dead.Rank(uint32(hi))
+	if lo > 0 {
+		c -= b.dead.Rank(uint32(lo - 1))
+	}
+	return int64(c)
+}
+
+func (b *subMap) markDead(i int64) bool {
+	if b.dead == nil {
+		b.dead = roaring.New()
+	}
+	return b.dead.CheckedAdd(uint32(i))
+}
+
 func (b *Range) Clone() *Range {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	b2 := &Range{}
+	b2 := &Range{mapping: b.mapping}
 	b2.start = b.start
 	b2.end = b.end
 	b2.fastTable = b.fastTable.Clone()
+	b2.setOptions(b.Options())
+	b2.storeValues = b.storeValues
 	for i := range b2.slots {
 		b2.slots[i] = b.slots[i].clone()
 	}
@@ -256,13 +459,24 @@ func (b *Range) Clone() *Range {
 }
 
 func (b *subMap) clone() *subMap {
+	b.ensure()
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	return &subMap{
-		keys:  b.keys,
-		spans: b.spans,
-		xfs:   b.xfs,
-	}
+	m := &subMap{
+		keys:     b.keys,
+		spans:    b.spans,
+		xfs:      b.xfs,
+		ts:       b.ts,
+		tsMin:    b.tsMin,
+		tsMax:    b.tsMax,
+		vals:     b.vals,
+		valSpans: b.valSpans,
+		mapping:  b.mapping,
+	}
+	if b.dead != nil {
+		m.dead = b.dead.Clone()
+	}
+	return m
 }
 
 func Unmarshal(rd io.Reader) (*Range, error) {
@@ -271,7 +485,18 @@ func Unmarshal(rd io.Reader) (*Range, error) {
 	if err := binary.Read(rd, binary.BigEndian, &ver); err != nil {
 		return nil, fmt.Errorf("read version: %v", err)
 	}
-	if ver == 4 {
+	rev, compressed, err := parseVersion(ver)
+	if err != nil {
+		return nil, err
+	}
+	if ver&fmtIndexed != 0 {
+		buf := bytes.NewBuffer([]byte{ver})
+		if _, err := buf.ReadFrom(rd); err != nil {
+			return nil, fmt.Errorf("read indexed range: %v", err)
+		}
+		return parseIndexed(buf.Bytes(), nil)
+	}
+	if compressed {
 		rd = lz4.NewReader(rd)
 	}
 
@@ -291,6 +516,11 @@ func Unmarshal(rd io.Reader) (*Range, error) {
 	if err := binary.Read(rd, binary.BigEndian, &z); err != nil {
 		return nil, fmt.Errorf("read hashNum: %v", err)
 	}
+	o, err := Options{HashNum: int(z)}.normalize()
+	if err != nil {
+		return nil, err
+	}
+	b.setOptions(o)
 
 	var topSize uint64
 	if err := binary.Read(rd, binary.BigEndian, &topSize); err != nil {
@@ -303,7 +533,7 @@ func Unmarshal(rd io.Reader) (*Range, error) {
 	}
 
 	for i := range b.slots {
-		b.slots[i], err = readSubMap(rd)
+		b.slots[i], err = readSubMap(rd, rev)
 		if err != nil {
 			return nil, err
 		}
@@ -324,7 +554,19 @@ func Unmarshal(rd io.Reader) (*Range, error) {
 	return b, nil
 }
 
-func readSubMap(rd io.Reader) (*subMap, error) {
+func parseVersion(ver byte) (rev byte, compressed bool, err error) {
+	switch {
+	case ver == fmtLegacy:
+		return 1, false, nil
+	case ver == fmtLegacyLZ4:
+		return 1, true, nil
+	case ver&fmtFlag != 0 && ver&fmtRevMask <= fmtRevision:
+		return ver & fmtRevMask, ver&fmtLZ4 != 0, nil
+	}
+	return 0, false, fmt.Errorf("unknown version %x", ver)
+}
+
+func readSubMap(rd io.Reader, rev byte) (*subMap, error) {
 	b := &subMap{}
 
 	var keysLen uint32
@@ -350,9 +592,71 @@ func readSubMap(rd io.Reader) (*subMap, error) {
 		}
 	}
 
+	if rev >= 2 {
+		var deadSize uint64
+		if err := binary.Read(rd, binary.BigEndian, &deadSize); err != nil {
+			return nil, fmt.Errorf("read tombstones size: %v", err)
+		}
+		if deadSize > 0 {
+			b.dead = roaring.New()
+			if _, err := b.dead.ReadFrom(io.LimitReader(rd, int64(deadSize))); err != nil {
+				return nil, fmt.Errorf("read tombstones: %v", err)
+			}
+		}
+	}
+
+	if rev >= 3 {
+		var tsLen, tsSize uint32
+		if err := binary.Read(rd, binary.BigEndian, &tsLen); err != nil {
+			return nil, fmt.Errorf("read timestamps length: %v", err)
+		}
+		if err := binary.Read(rd, binary.BigEndian, &tsSize); err != nil {
+			return nil, fmt.Errorf("read timestamps size: %v", err)
+		}
+		if tsLen > 0 {
+			if tsLen != keysLen {
+				return nil, fmt.Errorf("read timestamps: invalid length %d, expect %d", tsLen, keysLen)
+			}
+			tmp := make([]byte, tsSize)
+			if _, err := io.ReadFull(rd, tmp); err != nil {
+				return nil, fmt.Errorf("read timestamps: %v", err)
+			}
+			if err := b.decodeTimestamps(tmp, int(tsLen)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return b, nil
 }
 
+func (b *subMap) encodeTimestamps() []byte {
+	buf := make([]byte, 0, len(b.ts)*2)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	prev := int64(0)
+	for _, ts := range b.ts {
+		buf = append(buf, tmp[:binary.PutVarint(tmp, ts-prev)]...)
+		prev = ts
+	}
+	return buf
+}
+
+func (b *subMap) decodeTimestamps(buf []byte, n int) error {
+	b.ts = make([]int64, n)
+	prev := int64(0)
+	for i := range b.ts {
+		d, w := binary.Varint(buf)
+		if w <= 0 {
+			return fmt.Errorf("read timestamps: invalid varint at %d", i)
+		}
+		buf = buf[w:]
+		prev += d
+		b.ts[i] = prev
+		b.updateTsBounds(prev, i == 0)
+	}
+	return nil
+}
+
 func (b *Range) MarshalBinary(compress bool) []byte {
 	p := &bytes.Buffer{}
 	b.Marshal(p, compress)
@@ -362,77 +666,34 @@ func (b *Range) MarshalBinary(compress bool) []byte {
 func (b *Range) Marshal(w io.Writer, compress bool) (int, error) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-
-	mw := &meterWriter{Writer: w}
-
-	var zw io.WriteCloser
-	if compress {
-		mw.Write([]byte{4})
-		zw = lz4.NewWriter(mw)
-	} else {
-		mw.Write([]byte{1})
-		zw = mw
-	}
-
-	h := crc32.NewIEEE()
-	w = io.MultiWriter(zw, h)
-
-	if err := binary.Write(w, binary.BigEndian, b.start); err != nil {
-		return 0, err
-	}
-	if err := binary.Write(w, binary.BigEndian, b.end); err != nil {
-		return 0, err
-	}
-	if err := binary.Write(w, binary.BigEndian, byte(bfHash)); err != nil {
-		return 0, err
-	}
-	if err := binary.Write(w, binary.BigEndian, b.fastTable.GetSerializedSizeInBytes()); err != nil {
-		return 0, err
-	}
-	if _, err := b.fastTable.WriteTo(w); err != nil {
-		return 0, err
-	}
-	for _, h := range b.slots {
-		if err := h.writeTo(w); err != nil {
-			return 0, err
-		}
-	}
-	// Write CRC32 checksum to the end of stream.
-	if err := binary.Write(w, binary.BigEndian, h.Sum32()); err != nil {
-		return 0, err
-	}
-	if err := zw.Close(); err != nil {
-		return 0, err
-	}
-	return mw.size, nil
+	return b.marshalIndexed(w, compress)
 }
 
-func (b *subMap) writeTo(w io.Writer) error {
+// RoughSizeBytes returns the approximate memory size of the range. Data referencing
+// memory mapped files are counted as well, so caches bound mapped ranges too.
+func (b *Range) RoughSizeBytes() (sz int64) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-
-	if err := binary.Write(w, binary.BigEndian, uint32(len(b.keys))); err != nil {
-		return err
-	}
-	if _, err := w.Write(keysBytes(b.keys)); err != nil {
-		return err
-	}
-	if err := binary.Write(w, binary.BigEndian, b.spans); err != nil {
-		return err
+	sz += int64(b.fastTable.GetSizeInBytes())
+	for _, m := range b.slots {
+		sz += m.roughSizeBytes()
 	}
-	if err := binary.Write(w, binary.BigEndian, b.xfs); err != nil {
-		return err
+	if x := b.keyIndex(); x != nil {
+		sz += x.roughSizeBytes()
 	}
-	return nil
+	return
 }
 
-func (b *Range) RoughSizeBytes() (sz int64) {
+func (b *subMap) roughSizeBytes() (sz int64) {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	sz += int64(b.fastTable.GetSizeInBytes())
-	for i := range b.slots {
-		sz += int64(len(b.slots[i].xfs))
-		sz += int64(len(b.slots[i].keys)) * (int64(KeySize) + 4)
+	sz += int64(len(b.raw))
+	sz += int64(len(b.xfs))
+	sz += int64(len(b.keys)) * (int64(KeySize) + 4)
+	sz += int64(len(b.vals)) + int64(len(b.valSpans))*4
+	sz += int64(len(b.ts)) * 8
+	if b.dead != nil {
+		sz += int64(b.dead.GetSizeInBytes())
 	}
 	return
 }
@@ -454,24 +715,39 @@ func (b *Range) String() string {
 	fmt.Fprintf(buf, "fast table len: %d, approx hash num: %d, size: %db\n",
 		b.fastTable.GetCardinality(), m.GetCardinality()*32, b.fastTable.GetSerializedSizeInBytes())
 	for i, h := range b.slots {
-		h.debug(i, buf)
+		h.debug(i, b.slotSize, b.fastSlotSize, buf)
 	}
 
 	fmt.Fprintf(buf, "collected in %v", time.Since(start))
 	return buf.String()
 }
 
-func (b *subMap) debug(i int, buf io.Writer) {
+func (b *subMap) debug(i int, slotSize, fastSlotSize int64, buf io.Writer) {
+	if err := b.ensure(); err != nil {
+		fmt.Fprintf(buf, "[%02d;0x%05x] %v\n", i, int64(i)*slotSize, err)
+		return
+	}
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	if len(b.keys) > 0 {
-		fmt.Fprintf(buf, "[%02d;0x%05x] ", i, i*slotSize)
-		fmt.Fprintf(buf, "keys: %5d/%2d, last key: %v, filter size: %db\n",
-			len(b.keys), len(b.keys)/fastSlotSize, b.keys[len(b.keys)-1], len(b.xfs))
+		fmt.Fprintf(buf, "[%02d;0x%05x] ", i, int64(i)*slotSize)
+		fmt.Fprintf(buf, "keys: %5d/%2d, dead: %d, last key: %v, filter size: %db\n",
+			len(b.keys), int64(len(b.keys))/fastSlotSize, b.deadCount(0, int64(len(b.keys))-1), b.keys[len(b.keys)-1], len(b.xfs))
 	}
 }
 
-func (b *Range) joinFast(vs *Values) (res bitmap1024) {
+func (b *Range) joinFast(q *Query) (res bitmap1024) {
+	res, _ = b.joinFastBound(q)
+	return
+}
+
+// joinFastBound returns fast slots which may contain hits and the upper bound of
+// scores of these hits: the sum of weights of terms which may appear in them.
+func (b *Range) joinFastBound(q *Query) (res bitmap1024, bound float64) {
+	if q == nil {
+		return
+	}
+
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
@@ -481,20 +757,16 @@ func (b *Range) joinFast(vs *Values) (res bitmap1024) {
 	}
 
 	hashStates := map[uint32]*hashState{}
-	fill := func(hashes []uint64) [][4]uint32 {
-		var out [][4]uint32
-		for _, v := range hashes {
-			h := h16(uint32(v), b.start)
-			for i := 0; i < bfHash; i++ {
+	termHashes := map[uint64][4]uint32{}
+	q.walk(func(q *Query) {
+		if q.Op == OpTerm {
+			h := h16(uint32(q.Term), b.start)
+			for i := 0; i < b.hashNum; i++ {
 				hashStates[h[i]] = &hashState{h: h[i] & fastSlotMask}
 			}
-			out = append(out, h)
+			termHashes[q.Term] = h
 		}
-		return out
-	}
-	oneofHashes := fill(vs.Oneof)
-	majorHashes := fill(vs.Major)
-	exactHashes := fill(vs.Exact)
+	})
 
 	iter := b.fastTable.Iterator().(*roaring.IntIterator)
 	for _, hs := range hashStates {
@@ -509,80 +781,130 @@ func (b *Range) joinFast(vs *Values) (res bitmap1024) {
 		}
 	}
 
-	// z := time.Now()
-	var final *bitmap1024
-	for _, raw := range oneofHashes {
+	terms := make(map[uint64]*bitmap1024, len(termHashes))
+	for t, raw := range termHashes {
 		m := hashStates[raw[0]].bitmap1024
-		for i := 1; i < bfHash; i++ {
+		for i := 1; i < b.hashNum; i++ {
 			m.and(&hashStates[raw[i]].bitmap1024)
 		}
-		if final == nil {
-			final = &m
-		} else {
-			final.or(&m)
-		}
+		terms[t] = &m
 	}
 
-	var major *bitmap1024
-	var scores map[uint16]int
-	for _, raw := range majorHashes {
-		m := hashStates[raw[0]].bitmap1024
-		for i := 1; i < bfHash; i++ {
-			m.and(&hashStates[raw[i]].bitmap1024)
-		}
-		if major == nil {
-			major = &m
-			scores = map[uint16]int{}
-		} else {
-			major.or(&m)
+	final, all := q.fast(terms)
+	if all {
+		for i := int64(0); i <= b.end; i += b.fastSlotSize {
+			final.add(uint16(i / b.fastSlotSize))
 		}
-		m.iterate(func(x uint16) bool { scores[x]++; return true })
 	}
-	if major != nil {
-		ms := vs.majorScore()
-		var res bitmap1024
-		major.iterate(func(offset uint16) bool {
-			if scores[offset] >= ms {
-				res.add(offset)
-			}
-			return true
-		})
-		if final == nil {
-			final = &res
-		} else {
-			final.and(&res)
+	b.pruneDead(&final)
+
+	q.walkScored(func(t *Query) {
+		if m := terms[t.Term]; m.intersects(&final) {
+			bound += t.weight()
 		}
-	}
+	})
+	return final, bound
+}
 
-	for _, raw := range exactHashes {
-		m := hashStates[raw[0]].bitmap1024
-		for i := 1; i < bfHash; i++ {
-			m.and(&hashStates[raw[i]].bitmap1024)
+// pruneDead clears fast slots whose entries are all tombstoned.
+func (b *Range) pruneDead(fast *bitmap1024) {
+	fast.iterate(func(offset uint16) bool {
+		lo := int64(offset) * b.fastSlotSize
+		m := b.slots[lo/b.slotSize]
+		lo %= b.slotSize
+		hi := lo + b.fastSlotSize - 1
+
+		m.ensure()
+		m.mu.RLock()
+		if n := int64(len(m.keys)); hi >= n {
+			hi = n - 1
 		}
-		if final == nil {
-			final = &m
-		} else {
-			final.and(&m)
+		if hi >= lo && m.deadCount(lo, hi) == hi-lo+1 {
+			fast.remove(offset)
 		}
-	}
+		m.mu.RUnlock()
+		return true
+	})
+}
 
-	if final == nil {
-		return bitmap1024{}
+func (b *Range) Find(key Key) (int64, func(uint64) bool) {
+	off, ok := b.findOffset(key)
+	if !ok {
+		return 0, nil
 	}
-	return *final
+	m, i := b.slots[off/b.slotSize], off%b.slotSize
+	m.mu.RLock()
+	// Copy the filter, it may reference a memory mapped file.
+	x, vs := xfBuild(append([]byte{}, m.xfs[m.prevSpan(i):m.spans[i]]...))
+	m.mu.RUnlock()
+	return off, func(k uint64) bool { return xfContains(x, vs, k) }
 }
 
-func (b *Range) Find(key Key) (int64, func(uint64) bool) {
+// Delete tombstones all live entries of key in the range, returns false if none was found.
+// Tombstoned entries stay in the range until compaction but will never be returned again.
+func (b *Range) Delete(key Key) bool {
+	return b.deleteKey(key, b.Capacity())
+}
+
+// deleteKey tombstones live entries of key before offset 'before'.
+func (b *Range) deleteKey(key Key, before int64) bool {
+	var dead []int64
+	if offs, indexed := b.candidates(key); indexed {
+		for _, off := range offs {
+			if off >= before {
+				break
+			}
+			m := b.slots[off/b.slotSize]
+			m.mu.Lock()
+			if m.markDead(off % b.slotSize) {
+				dead = append(dead, off)
+			}
+			m.mu.Unlock()
+		}
+		b.segmu.Lock()
+		b.seg.trackDead(dead...)
+		b.segmu.Unlock()
+		return len(dead) > 0
+	}
 	for hr, m := range b.slots {
+		m.ensure()
 		m.mu.Lock()
 		for i, k := range m.keys {
-			if k == key {
-				x, vs := xfBuild(m.xfs[m.prevSpan(int64(i)):m.spans[i]])
-				m.mu.Unlock()
-				return int64(hr)*slotSize + int64(i), func(k uint64) bool { return xfContains(x, vs, k) }
+			off := int64(hr)*b.slotSize + int64(i)
+			if off >= before {
+				break
+			}
+			if k == key && m.markDead(int64(i)) {
+				dead = append(dead, off)
 			}
 		}
 		m.mu.Unlock()
 	}
-	return 0, nil
+	b.segmu.Lock()
+	b.seg.trackDead(dead...)
+	b.segmu.Unlock()
+	return len(dead) > 0
+}
+
+// DeleteById tombstones the entry at id, returns false if id is out of range or already deleted.
+func (b *Range) DeleteById(id int64) bool {
+	b.mu.RLock()
+	offset := id - b.start
+	if offset < 0 || offset > b.end {
+		b.mu.RUnlock()
+		return false
+	}
+	m := b.slots[offset/b.slotSize]
+	b.mu.RUnlock()
+
+	m.ensure()
+	m.mu.Lock()
+	ok := m.markDead(offset % b.slotSize)
+	m.mu.Unlock()
+	if ok {
+		b.segmu.Lock()
+		b.seg.trackDead(offset)
+		b.segmu.Unlock()
+	}
+	return ok
 }
@@ -7,11 +7,14 @@ import (
 	"github.com/coyove/sdss/contrib/clock"
 )
 
-var ErrBitmapFull = fmt.Errorf("bitmap full (%d)", Capcity)
+var ErrBitmapFull = fmt.Errorf("bitmap full")
 
 type aggTask struct {
 	key    Key
 	values []uint64
+	ts     int64
+	upsert bool
+	err    error // error of tombstoning older ranges, see upsertOlder
 	out    chan error
 }
 
@@ -26,8 +29,25 @@ type SaveAggregator struct {
 	}
 
 	window time.Duration
+
+	wal          *WAL
+	checkpoint   time.Duration
+	checkpointAt time.Time
+
+	// onBatch is called with every accepted batch, see Manager.ReplicationHandler.
+	onBatch func(b *Range, firstId int64, tasks []*aggTask)
+	batches *histogram
+
+	// onUpsert tombstones key in ranges older than the aggregated one before upserts
+	// are acknowledged, see Upsert.
+	onUpsert func(key Key, start int64) error
+
+	// storedValues is set once Manager.StoredValues is applied to the range.
+	storedValues bool
 }
 
+const DefaultCheckpointInterval = 10 * time.Second
+
 func (r *Range) AggregateSaves(callback func(*Range) error) *SaveAggregator {
 	fts := &SaveAggregator{}
 	fts.tasks = make(chan *aggTask, 10000)
@@ -35,6 +55,7 @@ func (r *Range) AggregateSaves(callback func(*Range) error) *SaveAggregator {
 	fts.cb = callback
 	fts.current = r
 	fts.window = 100 * time.Millisecond
+	fts.batches = newHistogram(batchBuckets)
 
 	go func() {
 		for fts.worker() {
@@ -49,6 +70,22 @@ func (sa *SaveAggregator) SetWindow(w time.Duration) *SaveAggregator {
 	return sa
 }
 
+// SetWAL makes the aggregator record each batch in w before acknowledging it,
+// callback will only be called as checkpoints: on the first batch, when the
+// checkpoint interval elapsed, or when the aggregator is closed.
+func (sa *SaveAggregator) SetWAL(w *WAL) *SaveAggregator {
+	sa.wal = w
+	if sa.checkpoint == 0 {
+		sa.checkpoint = DefaultCheckpointInterval
+	}
+	return sa
+}
+
+func (sa *SaveAggregator) SetCheckpointInterval(d time.Duration) *SaveAggregator {
+	sa.checkpoint = d
+	return sa
+}
+
 func (sa *SaveAggregator) Range() *Range {
 	return sa.current
 }
@@ -56,6 +93,24 @@ func (sa *SaveAggregator) Range() *Range {
 func (sa *SaveAggregator) Close() {
 	close(sa.tasks)
 	<-sa.workerOut
+	if sa.wal != nil {
+		if sa.wal.Size() > 0 {
+			sa.doCheckpoint()
+		}
+		sa.wal.Close()
+	}
+}
+
+func (sa *SaveAggregator) doCheckpoint() error {
+	if err := sa.cb(sa.current); err != nil {
+		return err
+	}
+	sa.checkpointAt = time.Now()
+	if sa.wal != nil {
+		// Failing to truncate is harmless, replaying skips saved entries.
+		sa.wal.Truncate()
+	}
+	return nil
 }
 
 func (sa *SaveAggregator) worker() bool {
@@ -85,6 +140,7 @@ MORE:
 		return true
 	}
 
+	sa.batches.observe(float64(len(tasks)))
 	sa.survey.c += len(tasks)
 	sa.survey.r += 1
 	if sa.survey.r > 100 {
@@ -92,8 +148,15 @@ MORE:
 		sa.survey.r = 1
 	}
 
+	firstId := sa.current.Len()
 	for i, t := range tasks {
-		if !sa.current.Add(t.key, t.values) {
+		var ok bool
+		if t.upsert {
+			ok = sa.current.UpsertAt(t.key, t.values, t.ts)
+		} else {
+			ok = sa.current.AddAt(t.key, t.values, t.ts)
+		}
+		if !ok {
 			for j := i; j < len(tasks); j++ {
 				tasks[j].out <- ErrBitmapFull
 			}
@@ -102,17 +165,60 @@ MORE:
 		}
 	}
 
-	err := sa.cb(sa.current)
+	var err error
+	logged := sa.wal != nil && len(tasks) > 0 && sa.wal.append(firstId, tasks) == nil
+	if logged {
+		// Tombstones in older ranges are redone by replaying logged upserts, so they
+		// must be done before the checkpoint truncates the WAL.
+		sa.upsertOlder(tasks)
+	}
+	if !logged || time.Since(sa.checkpointAt) >= sa.checkpoint {
+		err = sa.doCheckpoint()
+		if err == nil && !logged {
+			sa.upsertOlder(tasks)
+		}
+	}
+	// Failed batches are not published, followers missing them will resync.
+	if err == nil && sa.onBatch != nil && len(tasks) > 0 {
+		sa.onBatch(sa.current, firstId, tasks)
+	}
 	for _, t := range tasks {
-		t.out <- err
+		if err != nil {
+			t.out <- err
+		} else {
+			t.out <- t.err
+		}
 	}
 	return true
 }
 
+// upsertOlder tombstones keys of upserts in older ranges, errors are reported to
+// their tasks.
+func (sa *SaveAggregator) upsertOlder(tasks []*aggTask) {
+	if sa.onUpsert == nil {
+		return
+	}
+	for _, t := range tasks {
+		if t.upsert {
+			t.err = sa.onUpsert(t.key, sa.current.Start())
+		}
+	}
+}
+
 func (sa *SaveAggregator) AddAsync(key Key, values []uint64) chan error {
+	return sa.AddAtAsync(key, values, 0)
+}
+
+func (sa *SaveAggregator) AddAtAsync(key Key, values []uint64, ts int64) chan error {
+	return sa.addAsync(key, values, ts, false)
+}
+
+func (sa *SaveAggregator) addAsync(key Key, values []uint64, ts int64, upsert bool) chan error {
 	t := &aggTask{
 		key:    key,
 		values: values,
+		ts:     ts,
+		upsert: upsert,
 		out:    make(chan error, 1),
 	}
 	sa.tasks <- t
@@ -123,6 +229,27 @@ func (sa *SaveAggregator) Add(key Key, values []uint64) error {
 	return <-sa.AddAsync(key, values)
 }
 
+func (sa *SaveAggregator) AddAt(key Key, values []uint64, ts int64) error {
+	return <-sa.AddAtAsync(key, values, ts)
+}
+
+// Upsert adds key and tombstones its previous entries in the current range (see
+// Range.Upsert). For aggregators of managers, entries in older ranges (at most
+// Manager.UpsertRanges of them) are also tombstoned and saved before it returns. With a WAL, these tombstones are redone
+// when the WAL is replayed, so they survive crashes as the add does.
+func (sa *SaveAggregator) Upsert(key Key, values []uint64) error {
+	return sa.UpsertAt(key, values, 0)
+}
+
+func (sa *SaveAggregator) UpsertAt(key Key, values []uint64, ts int64) error {
+	return <-sa.addAsync(key, values, ts, true)
+}
+
+// QueueDepth returns the number of entries waiting to be added.
+func (sa *SaveAggregator) QueueDepth() int {
+	return len(sa.tasks)
+}
+
 func (sa *SaveAggregator) Metrics() float64 {
 	return float64(sa.survey.c) / float64(sa.survey.r)
 }
@@ -0,0 +1,425 @@
+package bitmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unsafe"
+
+	"github.com/coyove/sdss/contrib/roaring"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Indexed layout:
+//
+//	ver(1) start(8) end(8) hashNum(1) fastTableSize(8) flags(1) geometry(3) padding(2)
+//	fastTable(fastTableSize) padding(to 8)
+//	slotIndex([slotNum]{offset(8), size(8)}) headerChecksum(4) padding(to 8)
+//	slot blocks (8 bytes aligned)
+//
+// geometry is log2 of slotSize, slotNum and fastSlotSize if flags has hdrGeometry
+// set, see Options. Header fields are big endian while slot blocks are little
+// endian, so they can be referenced in place (e.g.: mmap) and decoded lazily.
+// Each slot block is:
+//
+//	keysLen(4) keys(keysLen*KeySize) spans(keysLen*4) xfsLen(4) xfs
+//	deadSize(4) dead tsLen(4) tsSize(4) ts [valsLen(4) valSpans(valsLen*4) valsSize(4) vals] checksum(4)
+//
+// Stored values are only written if the slot has any, see EnableStoredValues.
+//
+// If the version has fmtLZ4 set, each block is compressed individually:
+//
+//	rawSize(4) lz4Block
+//
+// rawSize is 0 if the block is incompressible and stored as is.
+const indexedFastTableOffset = 32
+
+const (
+	hdrStoredValues = 1
+	hdrGeometry     = 2
+)
+
+var nativeLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+func align8(n int) int {
+	return (n + 7) / 8 * 8
+}
+
+func (b *Range) marshalIndexed(w io.Writer, compress bool) (int, error) {
+	ver := byte(fmtFlag | fmtIndexed | fmtRevision)
+	blocks := make([][]byte, len(b.slots))
+	for i, m := range b.slots {
+		blocks[i] = m.encodeBlock()
+		if compress && len(blocks[i]) > 0 {
+			ver |= fmtLZ4
+			blk, err := compressBlock(blocks[i])
+			if err != nil {
+				return 0, err
+			}
+			blocks[i] = blk
+		}
+	}
+
+	hdr := &bytes.Buffer{}
+	hdr.WriteByte(ver)
+	binary.Write(hdr, binary.BigEndian, b.start)
+	binary.Write(hdr, binary.BigEndian, b.end)
+	hdr.WriteByte(byte(b.hashNum))
+	binary.Write(hdr, binary.BigEndian, b.fastTable.GetSerializedSizeInBytes())
+	flags := byte(hdrGeometry)
+	if b.storeValues {
+		flags |= hdrStoredValues
+	}
+	hdr.WriteByte(flags)
+	hdr.Write(b.Options().encodeGeometry())
+	hdr.Write(make([]byte, indexedFastTableOffset-hdr.Len()))
+	if _, err := b.fastTable.WriteTo(hdr); err != nil {
+		return 0, err
+	}
+	hdr.Write(make([]byte, align8(hdr.Len())-hdr.Len()))
+
+	offset := align8(hdr.Len() + len(b.slots)*16 + 4)
+	for _, blk := range blocks {
+		if len(blk) == 0 {
+			binary.Write(hdr, binary.BigEndian, [2]uint64{0, 0})
+			continue
+		}
+		binary.Write(hdr, binary.BigEndian, [2]uint64{uint64(offset), uint64(len(blk))})
+		offset = align8(offset + len(blk))
+	}
+	binary.Write(hdr, binary.BigEndian, crc32.ChecksumIEEE(hdr.Bytes()[1:]))
+	hdr.Write(make([]byte, align8(hdr.Len())-hdr.Len()))
+
+	mw := &meterWriter{Writer: w}
+	if _, err := mw.Write(hdr.Bytes()); err != nil {
+		return 0, err
+	}
+	for _, blk := range blocks {
+		if len(blk) == 0 {
+			continue
+		}
+		if _, err := mw.Write(blk); err != nil {
+			return 0, err
+		}
+		if _, err := mw.Write(make([]byte, align8(len(blk))-len(blk))); err != nil {
+			return 0, err
+		}
+	}
+	return mw.size, nil
+}
+
+// parseIndexed parses buf in indexed layout, slots are decoded lazily.
+// If mapping is not nil, buf is a read-only memory map of the file.
+func parseIndexed(buf []byte, mapping *mmapFile) (*Range, error) {
+	b, index, err := parseIndexedHeader(buf, int64(len(buf)))
+	if err != nil {
+		return nil, err
+	}
+	for i, blk := range index {
+		b.slots[i] = &subMap{rawLZ4: buf[0]&fmtLZ4 != 0, mapping: mapping}
+		if blk[1] > 0 {
+			b.slots[i].raw = buf[blk[0] : blk[0]+blk[1] : blk[0]+blk[1]]
+		}
+	}
+	b.mapping = mapping
+
+	n, count, err := b.applySegments(buf[b.seg.base:])
+	if err != nil {
+		return nil, err
+	}
+	b.seg.size, b.seg.end, b.seg.count = b.seg.base+int64(n), b.end, count
+	return b, nil
+}
+
+// OpenReaderAt reads the header of the range in indexed layout from r, slots will be
+// read from r, decompressed and decoded when they are first accessed. r must not
+// be modified or closed during the lifetime of the range.
+func OpenReaderAt(r io.ReaderAt, size int64) (*Range, error) {
+	hdr := make([]byte, indexedFastTableOffset)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("read header: %v", err)
+	}
+	if _, _, err := parseVersion(hdr[0]); err != nil {
+		return nil, err
+	}
+	if hdr[0]&fmtFlag == 0 || hdr[0]&fmtIndexed == 0 {
+		return nil, fmt.Errorf("version %x is not indexed", hdr[0])
+	}
+
+	o, err := parseGeometry(hdr)
+	if err != nil {
+		return nil, err
+	}
+	topSize := int64(binary.BigEndian.Uint64(hdr[18:]))
+	if topSize < 0 || topSize > size {
+		return nil, fmt.Errorf("read header: invalid fast table size %d", topSize)
+	}
+	hdr = append(hdr, make([]byte, align8(int(topSize))+o.SlotNum*16+4)...)
+	if _, err := r.ReadAt(hdr[indexedFastTableOffset:], indexedFastTableOffset); err != nil {
+		return nil, fmt.Errorf("read header: %v", err)
+	}
+
+	b, index, err := parseIndexedHeader(hdr, size)
+	if err != nil {
+		return nil, err
+	}
+	for i, blk := range index {
+		b.slots[i] = &subMap{rawLZ4: hdr[0]&fmtLZ4 != 0}
+		if blk[1] > 0 {
+			b.slots[i].rawSrc = r
+			b.slots[i].rawOff = int64(blk[0])
+			b.slots[i].rawLen = int(blk[1])
+		}
+	}
+
+	if size > b.seg.base {
+		buf := make([]byte, size-b.seg.base)
+		if _, err := r.ReadAt(buf, b.seg.base); err != nil {
+			return nil, fmt.Errorf("read segments: %v", err)
+		}
+		n, count, err := b.applySegments(buf)
+		if err != nil {
+			return nil, err
+		}
+		b.seg.size, b.seg.end, b.seg.count = b.seg.base+int64(n), b.end, count
+	}
+	return b, nil
+}
+
+// parseIndexedHeader parses the header in buf, blocks in the returned index are
+// checked against the total size of the range.
+func parseIndexedHeader(buf []byte, size int64) (*Range, [][2]uint64, error) {
+	if len(buf) < indexedFastTableOffset {
+		return nil, nil, fmt.Errorf("read header: short buffer %d", len(buf))
+	}
+	o, err := parseGeometry(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b := &Range{}
+	b.setOptions(o)
+	index := make([][2]uint64, o.SlotNum)
+	b.start = int64(binary.BigEndian.Uint64(buf[1:]))
+	b.end = int64(binary.BigEndian.Uint64(buf[9:]))
+	topSize := int(binary.BigEndian.Uint64(buf[18:]))
+	b.storeValues = buf[26]&hdrStoredValues != 0
+
+	idx := align8(indexedFastTableOffset + topSize)
+	hdrEnd := idx + o.SlotNum*16
+	if topSize < 0 || hdrEnd+4 > len(buf) {
+		return nil, index, fmt.Errorf("read header: invalid fast table size %d", topSize)
+	}
+	if verify, checksum := crc32.ChecksumIEEE(buf[1:hdrEnd]), binary.BigEndian.Uint32(buf[hdrEnd:]); verify != checksum {
+		return nil, index, fmt.Errorf("invalid header checksum %x and %x", verify, checksum)
+	}
+
+	b.fastTable = roaring.New()
+	top := buf[indexedFastTableOffset : indexedFastTableOffset+topSize]
+	if _, err := b.fastTable.ReadFrom(bytes.NewReader(top)); err != nil {
+		return nil, index, fmt.Errorf("read fast table bitmap: %v", err)
+	}
+
+	b.seg.base = int64(align8(hdrEnd + 4))
+	for i := range index {
+		offset := binary.BigEndian.Uint64(buf[idx+i*16:])
+		sz := binary.BigEndian.Uint64(buf[idx+i*16+8:])
+		if offset+sz < offset || offset+sz > uint64(size) {
+			return nil, index, fmt.Errorf("read slot %d: invalid block %d+%d", i, offset, sz)
+		}
+		index[i] = [2]uint64{offset, sz}
+		if end := int64(align8(int(offset + sz))); sz > 0 && end > b.seg.base {
+			b.seg.base = end
+		}
+	}
+	return b, index, nil
+}
+
+func (m *subMap) encodeBlock() []byte {
+	m.ensure()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.keys) == 0 {
+		return nil
+	}
+
+	p := &bytes.Buffer{}
+	binary.Write(p, binary.LittleEndian, uint32(len(m.keys)))
+	p.Write(keysBytes(m.keys))
+	binary.Write(p, binary.LittleEndian, m.spans)
+	binary.Write(p, binary.LittleEndian, uint32(len(m.xfs)))
+	p.Write(m.xfs)
+	if m.dead == nil || m.dead.IsEmpty() {
+		binary.Write(p, binary.LittleEndian, uint32(0))
+	} else {
+		binary.Write(p, binary.LittleEndian, uint32(m.dead.GetSerializedSizeInBytes()))
+		m.dead.WriteTo(p)
+	}
+	tsBuf := m.encodeTimestamps()
+	binary.Write(p, binary.LittleEndian, [2]uint32{uint32(len(m.ts)), uint32(len(tsBuf))})
+	p.Write(tsBuf)
+	if m.valSpans != nil {
+		binary.Write(p, binary.LittleEndian, uint32(len(m.valSpans)))
+		binary.Write(p, binary.LittleEndian, m.valSpans)
+		binary.Write(p, binary.LittleEndian, uint32(len(m.vals)))
+		p.Write(m.vals)
+	}
+	binary.Write(p, binary.LittleEndian, crc32.ChecksumIEEE(p.Bytes()))
+	return p.Bytes()
+}
+
+// ensure decodes the raw slot block if needed, it must be called before
+// accessing any field of subMap except by roughSizeBytes. Decoded fields are
+// published under mu, so it must not be called with mu held.
+func (m *subMap) ensure() error {
+	m.rawOnce.Do(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.rawErr = m.loadBlock()
+		m.raw, m.rawSrc = nil, nil
+	})
+	return m.rawErr
+}
+
+func (m *subMap) loadBlock() error {
+	buf := m.raw
+	if buf == nil && m.rawSrc != nil {
+		buf = make([]byte, m.rawLen)
+		if _, err := m.rawSrc.ReadAt(buf, m.rawOff); err != nil {
+			return fmt.Errorf("read block: %v", err)
+		}
+	}
+	if buf == nil {
+		return nil
+	}
+	if m.rawLZ4 {
+		var err error
+		if buf, err = uncompressBlock(buf); err != nil {
+			return err
+		}
+	}
+	return m.decodeBlock(buf)
+}
+
+func compressBlock(buf []byte) ([]byte, error) {
+	out := make([]byte, 4+lz4.CompressBlockBound(len(buf)))
+	n, err := lz4.CompressBlock(buf, out[4:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || n >= len(buf) {
+		return append(out[:4], buf...), nil
+	}
+	binary.LittleEndian.PutUint32(out, uint32(len(buf)))
+	return out[:4+n], nil
+}
+
+func uncompressBlock(buf []byte) ([]byte, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("read compressed block: short buffer")
+	}
+	rawSize := binary.LittleEndian.Uint32(buf)
+	if rawSize == 0 {
+		return buf[4:], nil
+	}
+	out := make([]byte, rawSize)
+	n, err := lz4.UncompressBlock(buf[4:], out)
+	if err != nil {
+		return nil, fmt.Errorf("decompress block: %v", err)
+	}
+	if n != len(out) {
+		return nil, fmt.Errorf("decompress block: expect %d bytes, got %d", len(out), n)
+	}
+	return out, nil
+}
+
+func (m *subMap) decodeBlock(buf []byte) (err error) {
+	if len(buf) < 4 {
+		return fmt.Errorf("read block: short buffer")
+	}
+	if verify, checksum := crc32.ChecksumIEEE(buf[:len(buf)-4]), binary.LittleEndian.Uint32(buf[len(buf)-4:]); verify != checksum {
+		return fmt.Errorf("invalid block checksum %x and %x", verify, checksum)
+	}
+	buf = buf[:len(buf)-4]
+
+	next := func(n int) []byte {
+		if n < 0 || n > len(buf) {
+			panic(fmt.Errorf("read block: short buffer, expect %d, got %d", n, len(buf)))
+		}
+		x := buf[:n:n]
+		buf = buf[n:]
+		return x
+	}
+	u32 := func() int { return int(binary.LittleEndian.Uint32(next(4))) }
+	defer func() {
+		if r := recover(); r != nil {
+			m.keys, m.spans, m.xfs, m.dead, m.ts = nil, nil, nil, nil, nil
+			m.vals, m.valSpans = nil, nil
+			err = r.(error)
+		}
+	}()
+
+	keysLen := u32()
+	m.keys = bytesKeys(next(keysLen * KeySize))
+	spans := next(keysLen * 4)
+	if nativeLittleEndian {
+		m.spans = bytesUint32s(spans)
+	} else {
+		m.spans = make([]uint32, keysLen)
+		binary.Read(bytes.NewReader(spans), binary.LittleEndian, m.spans)
+	}
+	m.xfs = next(u32())
+	if keysLen > 0 && int(m.spans[keysLen-1]) != len(m.xfs) {
+		panic(fmt.Errorf("read block: invalid xfs size %d, expect %d", len(m.xfs), m.spans[keysLen-1]))
+	}
+
+	if deadSize := u32(); deadSize > 0 {
+		m.dead = roaring.New()
+		if _, err := m.dead.ReadFrom(bytes.NewReader(next(deadSize))); err != nil {
+			panic(fmt.Errorf("read tombstones: %v", err))
+		}
+	}
+
+	tsLen, tsSize := u32(), u32()
+	if tsLen > 0 {
+		if tsLen != keysLen {
+			panic(fmt.Errorf("read timestamps: invalid length %d, expect %d", tsLen, keysLen))
+		}
+		if err := m.decodeTimestamps(next(tsSize), tsLen); err != nil {
+			panic(err)
+		}
+	}
+
+	if len(buf) > 0 {
+		if valsLen := u32(); valsLen != keysLen {
+			panic(fmt.Errorf("read stored values: invalid length %d, expect %d", valsLen, keysLen))
+		}
+		valSpans := next(keysLen * 4)
+		if nativeLittleEndian {
+			m.valSpans = bytesUint32s(valSpans)
+		} else {
+			m.valSpans = make([]uint32, keysLen)
+			binary.Read(bytes.NewReader(valSpans), binary.LittleEndian, m.valSpans)
+		}
+		m.vals = next(u32())
+		if keysLen > 0 && int(m.valSpans[keysLen-1]) != len(m.vals) {
+			panic(fmt.Errorf("read stored values: invalid size %d, expect %d", len(m.vals), m.valSpans[keysLen-1]))
+		}
+	}
+	return nil
+}
+
+func bytesUint32s(buf []byte) (x []uint32) {
+	*(*[3]int)(unsafe.Pointer(&x)) = [3]int{
+		*(*int)(unsafe.Pointer(&buf)),
+		len(buf) / 4,
+		len(buf) / 4,
+	}
+	return
+}
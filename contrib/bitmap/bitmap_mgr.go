@@ -1,6 +1,7 @@
 package bitmap
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -18,30 +19,107 @@ import (
 
 type Manager struct {
 	mu, reloadmu sync.Mutex
-	dirname      string
+	store        Storage
 	switchLimit  int64
+	opts         Options
 	dirFiles     []string
 	current      *SaveAggregator
+	curmu        sync.Mutex     // guards current for readers not holding mu, e.g.: workers
+	rangemu      [64]sync.Mutex // serializes compactions and tombstones, see rangeLock
 	loader       singleflight.Group
 	cache        *Cache
 
 	DirMaxFiles int
 
+	// RecencyHalfLife decays scores in CollectTopK by the age of ranges, 0 means no decay.
+	RecencyHalfLife time.Duration
+
+	// KeyIndex makes FindKey and Delete build key indexes of ranges they search,
+	// see Range.EnableKeyIndex.
+	KeyIndex bool
+
+	// UpsertRanges is the max number of older ranges searched by upserts for previous
+	// entries of keys, 0 means DefaultUpsertRanges. Ranges without key filters or key
+	// indexes are scanned linearly in the writer, ranges provided by Event.OnMissing
+	// are never searched.
+	UpsertRanges int
+
+	// StoredValues makes the current range keep values of entries added afterward,
+	// it is enabled once for each range by Saver, see Range.EnableStoredValues.
+	StoredValues bool
+
+	// Key filters of finished ranges, nil if not exist, see FindKey.
+	filtersmu sync.Mutex
+	filters   map[int64][]byte
+
+	// Prefetch is the number of ranges MultiWalkDesc loads ahead, 0 means runtime.NumCPU().
+	Prefetch int
+
+	statsOnce sync.Once
+	st        *managerStats
+
+	// KeyTime returns the unix milli timestamp of a key, 0 if unknown. It is used by
+	// Search to filter entries precisely, e.g.: ClockIdKeyTime.
+	KeyTime func(Key) int64
+
+	// KeyTimePrecision is the precision of KeyTime, e.g.: time.Second for
+	// ClockIdKeyTime. 0 means milliseconds.
+	KeyTimePrecision time.Duration
+
+	// SlowQueryThreshold is the minimal duration of queries reported to Event.OnSlowQuery.
+	SlowQueryThreshold time.Duration
+
+	// FeedSize is the max bytes of recent batches kept for followers, 0 means
+	// DefaultFeedSize and negative disables the feed, see ReplicationHandler.
+	FeedSize int
+	feed     feed
+
+	// Replica states, see NewReplicaManager.
+	readonly   bool
+	versionsmu sync.Mutex
+	versions   map[int64][2]int64
+	stop       chan struct{}
+
+	// Follower states, see NewFollowerManager.
+	tail *Range
+
 	Event struct {
-		OnLoaded  func(string, time.Duration)
-		OnSaved   func(string, int, error, time.Duration)
-		OnMissing func(int64) (*Range, error)
+		OnLoaded    func(string, time.Duration)
+		OnSaved     func(string, int, error, time.Duration)
+		OnMissing   func(int64) (*Range, error)
+		OnCompacted func(int64, *IdMapping, time.Duration)
+		// OnReplicated is called by followers after following a range.
+		OnReplicated func(int64, int, error)
+		// OnSlowQuery is called with traces of CollectSimple, CollectTopK and Search
+		// queries taking longer than SlowQueryThreshold.
+		OnSlowQuery func(*QueryTrace)
+		// OnWALFailed is called if the WAL of a new range can't be opened, the range
+		// will be fully saved on every batch instead, which is much slower.
+		OnWALFailed func(int64, error)
 	}
 }
 
+func (m *Manager) getName(base int64) string {
+	return fmt.Sprintf("%016x", base)
+}
+
+// getPath returns the identity of the range file, which is used as the cache key
+// and in events.
 func (m *Manager) getPath(base int64) string {
-	return filepath.Join(m.dirname, fmt.Sprintf("%016x", base))
+	if d, ok := m.store.(Dir); ok {
+		return filepath.Join(string(d), m.getName(base))
+	}
+	return fmt.Sprintf("%p/%s", m.store, m.getName(base))
 }
 
 func (m *Manager) saveAggImpl(b *Range) error {
 	start := time.Now()
 	fn := m.getPath(b.Start())
-	x, err := b.Save(fn, b.Len() >= m.switchLimit)
+	x, err := b.SaveIncrementalTo(m.store, m.getName(b.Start()), m.finished(b))
+	m.stats().observeSave(x, err, time.Since(start))
+	if err == nil && m.finished(b) {
+		err = m.saveKeyFilter(b)
+	}
 	if err == nil {
 		if bs, ok := m.Last(); !ok || bs != b.Start() {
 			err = m.ReloadFiles()
@@ -54,64 +132,95 @@ func (m *Manager) saveAggImpl(b *Range) error {
 }
 
 func (m *Manager) load(offset int64) (*Range, error) {
-	if offset == m.current.Range().Start() {
-		return m.current.Range(), nil
+	return m.loadContext(context.Background(), offset)
+}
+
+// loadContext loads the range starting at offset, it returns ctx.Err() once ctx is
+// done, while the loading continues in background and the range will be cached.
+func (m *Manager) loadContext(ctx context.Context, offset int64) (*Range, error) {
+	if b := m.currentRange(); b != nil && offset == b.Start() {
+		return b, nil
+	}
+	if b := m.tailRange(offset); b != nil {
+		return b, nil
 	}
 	fn := m.getPath(offset)
 	cached := m.cache.Get(fn)
 	if cached != nil {
 		return cached, nil
 	}
-	out, err, _ := m.loader.Do(fn, func() (interface{}, error) {
+	ch := m.loader.DoChan(fn, func() (interface{}, error) {
 		start := time.Now()
-		v, err := Load(fn)
+		if m.readonly {
+			// Stat before opening, so changes made in between will be caught later.
+			m.watch(offset)
+		}
+		v, err := OpenFrom(m.store, m.getName(offset))
 		if v == nil && err == nil {
 			return nil, nil
 		}
 		if m.Event.OnLoaded != nil {
 			m.Event.OnLoaded(fn, time.Since(start))
 		}
+		if err == nil {
+			m.stats().load.observe(time.Since(start).Seconds())
+			m.cache.Add(fn, v)
+		}
 		return v, err
 	})
-	if err != nil {
-		return nil, err
-	}
-	if out == nil {
-		return nil, nil
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		if res.Val == nil {
+			return nil, nil
+		}
+		return res.Val.(*Range), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	m.cache.Add(fn, out.(*Range))
-	return out.(*Range), nil
+}
+
+// files returns the sorted names of range files, the slice is never modified.
+func (m *Manager) files() []string {
+	m.reloadmu.Lock()
+	defer m.reloadmu.Unlock()
+	return m.dirFiles
 }
 
 func (m *Manager) findNext(mark int64) (int64, bool) {
+	dirFiles := m.files()
 	marks := fmt.Sprintf("%016x", mark)
-	idx := sort.SearchStrings(m.dirFiles, marks)
-	if idx >= len(m.dirFiles) {
+	idx := sort.SearchStrings(dirFiles, marks)
+	if idx >= len(dirFiles) {
 		return 0, true
 	}
-	if m.dirFiles[idx] == marks {
+	if dirFiles[idx] == marks {
 		idx++
+		if idx >= len(dirFiles) {
+			return 0, true
+		}
 	}
-	prev, _ := strconv.ParseInt(m.dirFiles[idx], 16, 64)
+	prev, _ := strconv.ParseInt(dirFiles[idx], 16, 64)
 	return prev, false
 }
 
 func (m *Manager) findPrev(mark int64) (int64, bool) {
+	dirFiles := m.files()
 	marks := fmt.Sprintf("%016x", mark)
-	idx := sort.SearchStrings(m.dirFiles, marks)
-	if idx >= len(m.dirFiles) {
-		idx = len(m.dirFiles)
+	idx := sort.SearchStrings(dirFiles, marks)
+	if idx >= len(dirFiles) {
+		idx = len(dirFiles)
 	}
 	if idx == 0 {
 		return 0, true
 	}
-	prev, _ := strconv.ParseInt(m.dirFiles[idx-1], 16, 64)
+	prev, _ := strconv.ParseInt(dirFiles[idx-1], 16, 64)
 	return prev, false
 }
 
 func (m *Manager) Last() (int64, bool) {
-	m.reloadmu.Lock()
-	defer m.reloadmu.Unlock()
 	v, empty := m.findPrev(clock.UnixMilli() + 1)
 	return v, !empty
 }
@@ -119,33 +228,35 @@ func (m *Manager) Last() (int64, bool) {
 func (m *Manager) ReloadFiles() error {
 	m.reloadmu.Lock()
 	defer m.reloadmu.Unlock()
-	df, err := os.Open(m.dirname)
-	if err != nil {
-		return err
-	}
-	defer df.Close()
-	names, err := df.Readdirnames(-1)
+	names, err := m.store.List()
 	if err != nil {
 		return err
 	}
 
 	for i := len(names) - 1; i >= 0; i-- {
-		if strings.HasSuffix(names[i], ".mtfbak") {
+		if strings.HasSuffix(names[i], ".mtfbak") || strings.HasSuffix(names[i], ".wal") ||
+			strings.HasSuffix(names[i], ".keys") {
 			names = append(names[:i], names[i+1:]...)
 		}
 	}
 
 	sort.Strings(names)
-	if m.DirMaxFiles > 0 {
+	if m.DirMaxFiles > 0 && !m.readonly {
 		for len(names) > m.DirMaxFiles {
-			os.Remove(filepath.Join(m.dirname, names[0]))
+			m.store.Remove(names[0])
+			m.store.Remove(names[0] + ".keys")
+			if base, err := strconv.ParseInt(names[0], 16, 64); err == nil {
+				m.filtersmu.Lock()
+				delete(m.filters, base)
+				m.filtersmu.Unlock()
+			}
 			names = names[1:]
 		}
 	}
 
 	for _, n := range names {
 		if _, err := strconv.ParseInt(n, 16, 64); err != nil {
-			return fmt.Errorf("invalid filename %s/%s: %v", m.dirname, n, err)
+			return fmt.Errorf("invalid filename %v/%s: %v", m.store, n, err)
 		}
 	}
 	m.dirFiles = names
@@ -156,13 +267,45 @@ func NewManager(dir string, switchLimit int64, cache *Cache) (*Manager, error) {
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, err
 	}
+	return NewStorageManager(Dir(dir), switchLimit, cache)
+}
+
+// NewManagerWithOptions is NewManager but new ranges are created with geometry o.
+func NewManagerWithOptions(dir string, switchLimit int64, cache *Cache, o Options) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return NewStorageManagerWithOptions(Dir(dir), switchLimit, cache, o)
+}
+
+// NewStorageManager creates a manager storing ranges in s. WAL and incremental saving
+// are only available if s is a FileStorage.
+func NewStorageManager(s Storage, switchLimit int64, cache *Cache) (*Manager, error) {
+	return NewStorageManagerWithOptions(s, switchLimit, cache, Options{})
+}
+
+// NewStorageManagerWithOptions is NewStorageManager but new ranges are created with
+// geometry o, switchLimit must not exceed their capacity. Existing ranges keep their
+// own geometry, and are finished at their capacities if smaller than switchLimit.
+func NewStorageManagerWithOptions(s Storage, switchLimit int64, cache *Cache, o Options) (*Manager, error) {
+	o, err := o.normalize()
+	if err != nil {
+		return nil, err
+	}
+	if c := int64(o.SlotSize) * int64(o.SlotNum); switchLimit > c {
+		return nil, fmt.Errorf("switch limit %d exceeds the capacity %d of ranges", switchLimit, c)
+	}
 	if cache == nil {
 		cache = NewLRUCache(0)
 	}
 	m := &Manager{
-		dirname:     dir,
+		store:       s,
 		cache:       cache,
 		switchLimit: switchLimit,
+		opts:        o,
+	}
+	if err := m.replayWALs(); err != nil {
+		return nil, err
 	}
 	if err := m.ReloadFiles(); err != nil {
 		return nil, err
@@ -171,27 +314,180 @@ func NewManager(dir string, switchLimit int64, cache *Cache) (*Manager, error) {
 	normBase := clock.UnixMilli()
 	prevBase, isEmpty := m.findPrev(normBase + 1)
 	if isEmpty {
-		m.current = New(normBase).AggregateSaves(m.saveAggImpl)
-	} else {
-		b, err := Load(m.getPath(prevBase))
+		return m, m.newSaver(newRange(normBase, m.opts))
+	}
+	b, err := OpenFrom(m.store, m.getName(prevBase))
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("range %v/%s: not found", m.store, m.getName(prevBase))
+	}
+	return m, m.newSaver(b)
+}
+
+// replayWALs replays and checkpoints all WALs left by the last run. Tombstones of
+// logged upserts in older ranges are redone, since they may be lost by crashes.
+func (m *Manager) replayWALs() error {
+	fs, ok := m.store.(FileStorage)
+	if !ok {
+		return nil
+	}
+	if err := m.ReloadFiles(); err != nil {
+		return err
+	}
+	names, err := fs.List()
+	if err != nil {
+		return err
+	}
+	for _, fn := range names {
+		if !strings.HasSuffix(fn, ".wal") {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(fn, ".wal"), 16, 64)
+		if err != nil {
+			return fmt.Errorf("invalid filename %v/%s: %v", fs, fn, err)
+		}
+		b, err := OpenFrom(fs, m.getName(base))
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			b = newRange(base, m.opts)
+		}
+		w, err := OpenWALFrom(fs, fn)
+		if err != nil {
+			return err
+		}
+		n, upserts, err := w.replay(b)
 		if err != nil {
-			return nil, err
+			w.f.Close()
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		if n > 0 {
+			if err := m.saveRange(b); err != nil {
+				w.f.Close()
+				return err
+			}
 		}
-		m.current = b.AggregateSaves(m.saveAggImpl)
+		for _, k := range upserts {
+			if err := m.deleteOlder(k, base); err != nil {
+				w.f.Close()
+				return err
+			}
+		}
+		if err := w.Truncate(); err != nil {
+			w.f.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) newSaver(b *Range) error {
+	fs, ok := m.store.(FileStorage)
+	if !ok {
+		m.setCurrent(m.aggregate(b))
+		return nil
+	}
+	w, err := OpenWALFrom(fs, m.getName(b.Start())+".wal")
+	if err != nil {
+		return err
+	}
+	m.setCurrent(m.aggregate(b).SetWAL(w))
+	return nil
+}
+
+func (m *Manager) setCurrent(sa *SaveAggregator) {
+	m.curmu.Lock()
+	defer m.curmu.Unlock()
+	m.current = sa
+}
+
+func (m *Manager) currentRange() *Range {
+	m.curmu.Lock()
+	defer m.curmu.Unlock()
+	if m.current == nil {
+		return nil
 	}
-	return m, nil
+	return m.current.Range()
 }
 
+func (m *Manager) aggregate(b *Range) *SaveAggregator {
+	m.feed.open(b)
+	sa := b.AggregateSaves(m.saveAggImpl)
+	sa.onBatch = m.publish
+	sa.batches = m.stats().batch
+	sa.onUpsert = m.deleteOlder
+	return sa
+}
+
+// Saver returns the aggregator of the current range, nil if the manager is a replica.
 func (m *Manager) Saver() *SaveAggregator {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if m.current.Range().Len() >= m.switchLimit {
+	if m.readonly {
+		return nil
+	}
+	if m.finished(m.current.Range()) {
 		m.current.Close()
-		m.current = New(clock.UnixMilli()).AggregateSaves(m.saveAggImpl)
+		b := newRange(m.nextStart(), m.opts)
+		if err := m.newSaver(b); err != nil {
+			// Fall back to saving every batch without WAL.
+			m.setCurrent(m.aggregate(b))
+			if m.Event.OnWALFailed != nil {
+				m.Event.OnWALFailed(b.Start(), err)
+			}
+		}
+	}
+	if m.StoredValues && !m.current.storedValues {
+		m.current.Range().EnableStoredValues()
+		m.current.storedValues = true
 	}
 	return m.current
 }
 
+// finished reports whether b reached the switch limit, ranges reopened with smaller
+// geometries are finished at their capacities.
+func (m *Manager) finished(b *Range) bool {
+	n := m.switchLimit
+	if c := b.Capacity(); c < n {
+		n = c
+	}
+	return b.Len() >= n
+}
+
+// Options returns the geometry of new ranges.
+func (m *Manager) Options() Options {
+	return m.opts
+}
+
+// nextStart returns the start of the next range, which must be later than the
+// current one, it waits if the current range was filled within a millisecond.
+func (m *Manager) nextStart() int64 {
+	for {
+		if start := clock.UnixMilli(); start > m.current.Range().Start() {
+			return start
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// Close checkpoints the current range and stops accepting adds. Replicas stop
+// following the primary.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readonly {
+		m.stopFollow()
+		return
+	}
+	m.current.Close()
+}
+
 func (m *Manager) WalkAsc(start int64, f func(*Range) bool) (err error) {
 	for {
 		if start == 0 {
@@ -214,9 +510,19 @@ func (m *Manager) WalkAsc(start int64, f func(*Range) bool) (err error) {
 }
 
 func (m *Manager) WalkDesc(start int64, f func(*Range) bool) (err error) {
+	return m.WalkDescContext(context.Background(), start, f)
+}
+
+// WalkDescContext is WalkDesc but returns ctx.Err() once ctx is done, which is
+// checked before loading each range.
+func (m *Manager) WalkDescContext(ctx context.Context, start int64, f func(*Range) bool) (err error) {
 	for {
 		var b *Range
 
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		prev, isFirst := m.findPrev(start + 1)
 		if isFirst {
 			if m.Event.OnMissing != nil {
@@ -225,7 +531,7 @@ func (m *Manager) WalkDesc(start int64, f func(*Range) bool) (err error) {
 			}
 			return io.EOF
 		}
-		b, err = m.load(prev)
+		b, err = m.loadContext(ctx, prev)
 
 	LOADED:
 		if err != nil {
@@ -239,61 +545,177 @@ func (m *Manager) WalkDesc(start int64, f func(*Range) bool) (err error) {
 }
 
 func (m *Manager) MultiWalkDesc(start int64, f func(*Range) bool) (err error) {
-	w := runtime.NumCPU()
+	return m.MultiWalkDescContext(context.Background(), start, f)
+}
+
+// MultiWalkDescContext is WalkDescContext but loads up to Prefetch upcoming ranges in
+// parallel, ranges are still passed to f one by one in descending order. Loading
+// stops at the first error, which will be returned.
+func (m *Manager) MultiWalkDescContext(ctx context.Context, start int64, f func(*Range) bool) error {
+	w := m.Prefetch
+	if w <= 0 {
+		w = runtime.NumCPU()
+	}
+
+	type loaded struct {
+		b   *Range
+		err error
+	}
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var pending []chan loaded
+	exhausted := false
 	for {
-		var starts []int64
-		for i := 0; i < w; i++ {
+		for !exhausted && len(pending) < w {
 			prev, isFirst := m.findPrev(start + 1)
 			if isFirst {
+				exhausted = true
 				break
 			}
-			starts = append(starts, prev)
+			out := make(chan loaded, 1)
+			go func(s int64) {
+				b, err := m.loadContext(lctx, s)
+				out <- loaded{b, err}
+			}(prev)
+			pending = append(pending, out)
 			start = prev - 1
 		}
 
-		if len(starts) == 0 {
+		if len(pending) == 0 {
 			return io.EOF
 		}
-
-		var exited bool
-		var outErr error
-		var wg sync.WaitGroup
-		wg.Add(len(starts))
-		for _, s := range starts {
-			go func(s int64) {
-				defer wg.Done()
-				b, err := m.load(s)
-				if err != nil {
-					exited, outErr = true, err
-					return
-				}
-				if b != nil && !f(b) {
-					exited = true
-				}
-			}(s)
+		var res loaded
+		select {
+		case res = <-pending[0]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		pending = pending[1:]
+		if res.err != nil {
+			return res.err
 		}
-		wg.Wait()
-		if exited {
-			return outErr
+		if res.b != nil && !f(res.b) {
+			return nil
 		}
 	}
 }
 
 func (m *Manager) String() string {
+	if m.readonly {
+		return fmt.Sprintf("files: %d, replica, cache: %d(%db)",
+			len(m.files()), m.cache.Len(), m.cache.curWeight)
+	}
 	return fmt.Sprintf("files: %d, saver: %.1f, cache: %d(%db)",
-		len(m.dirFiles), m.current.Metrics(), m.cache.Len(), m.cache.curWeight)
+		len(m.files()), m.current.Metrics(), m.cache.Len(), m.cache.curWeight)
 }
 
 func (m *Manager) CollectSimple(dedup interface{ Add(Key) bool }, vs Values, n int) (res []KeyIdScore, jms []JoinMetrics) {
-	m.WalkDesc(clock.UnixMilli(), func(b *Range) bool {
-		jm := b.Join(vs, -1, true, func(kis KeyIdScore) bool {
+	res, jms, _ = m.CollectSimpleContext(context.Background(), dedup, vs, n)
+	return
+}
+
+// CollectSimpleContext is CollectSimple but stops once ctx is done, hits collected
+// so far will be returned along with ctx.Err().
+func (m *Manager) CollectSimpleContext(ctx context.Context, dedup interface{ Add(Key) bool }, vs Values, n int) (res []KeyIdScore, jms []JoinMetrics, err error) {
+	start := time.Now()
+	err = m.WalkDescContext(ctx, clock.UnixMilli(), func(b *Range) bool {
+		jm := b.JoinContext(ctx, vs, -1, true, func(kis KeyIdScore) bool {
 			if dedup.Add(kis.Key) {
 				res = append(res, kis)
 			}
 			return len(res) < n
 		})
 		jms = append(jms, jm)
-		return len(res) < n
+		return len(res) < n && jm.Err == nil
+	})
+	err = walkErr(err, jms)
+	m.stats().observeJoins(jms)
+	m.traceSlow(start, jms, len(res), err)
+	return
+}
+
+// Delete tombstones key in the newest range containing it and persists that range.
+// Older ranges are not searched once the key is found.
+func (m *Manager) Delete(key Key) (found bool, err error) {
+	if m.readonly {
+		return false, ErrReadOnly
+	}
+	var saveErr error
+	err = m.walkKey(key, 0, func(b *Range) bool {
+		found, saveErr = m.tombstone(b, key)
+		return !found && saveErr == nil
 	})
+	if err == nil {
+		err = saveErr
+	}
 	return
 }
+
+const DefaultUpsertRanges = 16
+
+// deleteOlder tombstones key in at most UpsertRanges ranges older than start, ranges
+// are skipped by their key filters, see FindKey.
+func (m *Manager) deleteOlder(key Key, start int64) error {
+	n := m.UpsertRanges
+	if n <= 0 {
+		n = DefaultUpsertRanges
+	}
+	files := m.files()
+	idx := sort.SearchStrings(files, fmt.Sprintf("%016x", start))
+	if idx == 0 {
+		return nil
+	}
+	if idx -= n; idx < 0 {
+		idx = 0
+	}
+	since, _ := strconv.ParseInt(files[idx], 16, 64)
+
+	var saveErr error
+	err := m.walkKey(key, since, func(b *Range) bool {
+		if b.Start() < start {
+			if _, err := m.tombstone(b, key); err != nil && saveErr == nil {
+				saveErr = err
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// tombstone deletes key in b and saves it. b is reloaded under its range lock, since
+// it may have been replaced by Compact.
+func (m *Manager) tombstone(b *Range, key Key) (bool, error) {
+	mu := m.rangeLock(b.Start())
+	mu.Lock()
+	defer mu.Unlock()
+	if nb, err := m.load(b.Start()); err != nil {
+		return false, err
+	} else if nb != nil {
+		b = nb
+	}
+	if !b.Delete(key) {
+		return false, nil
+	}
+	return true, m.saveRange(b)
+}
+
+// rangeLock returns the lock of the range starting at start, which must be held
+// while modifying and saving finished ranges.
+func (m *Manager) rangeLock(start int64) *sync.Mutex {
+	return &m.rangemu[uint64(start)%uint64(len(m.rangemu))]
+}
+
+func (m *Manager) saveRange(b *Range) error {
+	start := time.Now()
+	fn := m.getPath(b.Start())
+	x, err := b.SaveIncrementalTo(m.store, m.getName(b.Start()), m.finished(b))
+	m.stats().observeSave(x, err, time.Since(start))
+	if m.Event.OnSaved != nil {
+		m.Event.OnSaved(fn, x, err, time.Since(start))
+	}
+	return err
+}
@@ -364,3 +364,623 @@ func TestManager(t *testing.T) {
 func TestJump(t *testing.T) {
 
 }
+
+func TestDelete(t *testing.T) {
+	b := New(0)
+	for i := 0; i < 1000; i++ {
+		b.Add(Uint64Key(uint64(i)), []uint64{uint64(i % 10), 100})
+	}
+
+	collect := func(b *Range) (res []KeyIdScore) {
+		b.Join(Values{Exact: []uint64{3}}, -1, true, func(kis KeyIdScore) bool {
+			res = append(res, kis)
+			return true
+		})
+		return
+	}
+	if n := len(collect(b)); n != 100 {
+		t.Fatal(n)
+	}
+
+	if !b.Delete(Uint64Key(3)) || b.Delete(Uint64Key(3)) {
+		t.Fatal("delete key")
+	}
+	if !b.DeleteById(13) || b.DeleteById(13) || b.DeleteById(1000) {
+		t.Fatal("delete id")
+	}
+	if id, _ := b.Find(Uint64Key(3)); id != 0 {
+		t.Fatal("find deleted key", id)
+	}
+
+	b2, err := Unmarshal(bytes.NewReader(b.MarshalBinary(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Range{b, b2} {
+		res := collect(b)
+		if len(res) != 98 {
+			t.Fatal(len(res))
+		}
+		for _, kis := range res {
+			if kis.Id == 3 || kis.Id == 13 {
+				t.Fatal(kis)
+			}
+		}
+	}
+
+	// Fast slot whose entries are all deleted should be pruned.
+	for i := 0; i < fastSlotSize; i++ {
+		b2.DeleteById(int64(i))
+	}
+	fast := b2.joinFast(QueryTerm(100))
+	if fast.contains(0) || !fast.contains(1) {
+		t.Fatal(fast)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	b := New(100)
+	for i := 0; i < 2000; i++ {
+		b.Add(Uint64Key(uint64(i)), []uint64{uint64(i % 10), uint64(i)})
+	}
+	for i := 0; i < 2000; i += 3 {
+		b.DeleteById(100 + int64(i))
+	}
+
+	n, im := b.Compact(func(kis KeyIdScore) bool { return kis.Key.LowUint64() < 500 })
+	if n.DeadLen() != 0 || n.Len()+im.Removed() != b.Len() {
+		t.Fatal(n.Len(), im.Removed())
+	}
+
+	for i := 0; i < 2000; i++ {
+		newId, ok := im.Map(100 + int64(i))
+		if ok != (i >= 500 && i%3 != 0) {
+			t.Fatal(i, ok)
+		}
+		if !ok {
+			continue
+		}
+		var res []KeyIdScore
+		n.Join(Values{Exact: []uint64{uint64(i)}}, -1, true, func(kis KeyIdScore) bool {
+			res = append(res, kis)
+			return true
+		})
+		if len(res) != 1 || res[0].Id != newId || res[0].Key != Uint64Key(uint64(i)) {
+			t.Fatal(i, res, newId)
+		}
+	}
+}
+
+func TestManagerCompactDelete(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 100, NewLRUCache(1e6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts := fillManager(t, m, 0, 300, nil)
+
+	stop, done := make(chan bool), make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := m.Compact(starts[0], func(kis KeyIdScore) bool { return kis.Key.LowUint64()%10 == 0 }); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		if found, err := m.Delete(Uint64Key(uint64(i))); !found || err != nil {
+			t.Fatal(i, found, err)
+		}
+	}
+	close(stop)
+	<-done
+	m.Close()
+
+	m, err = NewManager(dir, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	res, _ := m.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 1000)
+	if len(res) != 200 {
+		t.Fatal(len(res))
+	}
+	for _, kis := range res {
+		if kis.Key.LowUint64() < 100 {
+			t.Fatal(kis)
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	b := New(0)
+	for i := 0; i < 1000; i++ {
+		v := []uint64{1000 + uint64(i%2), 2000 + uint64(i%3)}
+		if i%100 == 0 {
+			// Large value set to use xor filters instead of raw values.
+			for j := 0; j < 20; j++ {
+				v = append(v, uint64(i*100+j+10000))
+			}
+		}
+		b.Add(Uint64Key(uint64(i)), v)
+	}
+
+	var res []KeyIdScore
+	jm := b.Join(Values{Exact: []uint64{1000}, Exclude: []uint64{2000, 2001}}, -1, true, func(kis KeyIdScore) bool {
+		res = append(res, kis)
+		return true
+	})
+	// Entries remaining: i%2==0 && i%3==2, minus possible xor false positives.
+	if len(res) > 167 || len(res) < 160 {
+		t.Fatal(len(res), jm)
+	}
+	for _, kis := range res {
+		if kis.Id%2 != 0 || kis.Id%3 != 2 {
+			t.Fatal(kis)
+		}
+	}
+
+	// Exclude only: scan all.
+	res = res[:0]
+	b.Join(Values{Exclude: []uint64{1001}}, -1, true, func(kis KeyIdScore) bool {
+		res = append(res, kis)
+		return true
+	})
+	if len(res) > 500 || len(res) < 495 {
+		t.Fatal(len(res))
+	}
+
+	// Values appearing in both Exact and Exclude are treated as excluded.
+	vs := Values{Exact: []uint64{1, 2}, Exclude: []uint64{2}}
+	vs.Clean()
+	if len(vs.Exact) != 1 || len(vs.Exclude) != 1 {
+		t.Fatal(vs)
+	}
+}
+
+func TestCollectTopK(t *testing.T) {
+	m, err := NewManager(t.TempDir(), 15, NewLRUCache(1e6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entry i contains values [0, i%7], scores are the number of matched Major values.
+	score := map[Key]float64{}
+	for i := 0; i < 60; i++ {
+		var v []uint64
+		for j := 0; j <= i%7; j++ {
+			v = append(v, uint64(j))
+		}
+		if err := m.Saver().Add(Uint64Key(uint64(i)), v); err != nil {
+			t.Fatal(err)
+		}
+		score[Uint64Key(uint64(i))] = float64(len(v))
+		time.Sleep(time.Millisecond)
+	}
+
+	vs := Values{Major: []uint64{0, 1, 2, 3, 4, 5, 6}, MinScore: 1}
+	res, jms := m.CollectTopK(vs, 8, 0)
+	if len(res) != 8 {
+		t.Fatal(len(res), jms)
+	}
+	for i, kis := range res {
+		if kis.Score != score[kis.Key] || kis.Score < 7 {
+			t.Fatal(i, kis)
+		}
+	}
+
+	// With a very short half life, newer entries win although their raw scores are lower.
+	m.RecencyHalfLife = time.Millisecond
+	res, _ = m.CollectTopK(vs, 3, 0)
+	if len(res) != 3 || res[0].Key.LowUint64() < 45 {
+		t.Fatal(res)
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i].Score > res[i-1].Score {
+			t.Fatal(res)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	m, err := NewManager(t.TempDir(), 5, NewLRUCache(1e6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := map[Key]int64{}
+	var phases []time.Time
+	for p := 0; p < 4; p++ {
+		time.Sleep(20 * time.Millisecond)
+		phases = append(phases, clock.Now())
+		var outs []chan error
+		sa := m.Saver()
+		for i := 0; i < 5; i++ {
+			k := Uint64Key(uint64(p*5 + i))
+			added[k] = clock.UnixMilli()
+			outs = append(outs, sa.AddAsync(k, []uint64{1}))
+		}
+		for _, out := range outs {
+			if err := <-out; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	m.KeyTime = func(k Key) int64 { return added[k] }
+
+	res, _ := m.Search(Values{Exact: []uint64{1}}, phases[1], phases[2].Add(-time.Millisecond), 100, nil)
+	if len(res) != 5 {
+		t.Fatal(res)
+	}
+	for _, kis := range res {
+		if p := kis.Key.LowUint64() / 5; p != 1 {
+			t.Fatal(kis)
+		}
+	}
+
+	res, jms := m.Search(Values{Exact: []uint64{1}}, phases[2], time.Time{}, 100, nil)
+	// The range of phase 1 may be walked if the range of phase 2 started late.
+	if len(res) != 10 || len(jms) < 2 || len(jms) > 3 {
+		t.Fatal(res, jms)
+	}
+}
+
+func TestSearchKeyTimePrecision(t *testing.T) {
+	m, err := NewManager(t.TempDir(), 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.KeyTime = ClockIdKeyTime
+	m.KeyTimePrecision = time.Second
+
+	// The key time is truncated to seconds, thus before 'from'.
+	for clock.UnixMilli()%1000 < 200 || clock.UnixMilli()%1000 > 800 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := m.Saver().Add(Uint64Key(clock.Id()), []uint64{1}); err != nil {
+		t.Fatal(err)
+	}
+	from := clock.Now().Add(-100 * time.Millisecond)
+	if res, _ := m.Search(Values{Exact: []uint64{1}}, from, time.Time{}, 10, nil); len(res) != 1 {
+		t.Fatal(res)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	b := New(0)
+	for i := 0; i < 100; i++ {
+		b.Add(Uint64Key(uint64(i)), []uint64{1})
+	}
+	for i := 100; i < slotSize+100; i++ {
+		b.AddAt(Uint64Key(uint64(i)), []uint64{1}, 1e12+int64(i)*10)
+	}
+
+	b2, err := Unmarshal(bytes.NewReader(b.MarshalBinary(false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Range{b, b2} {
+		var res []KeyIdScore
+		jm := b.JoinQuery(QueryAnd(QueryTerm(1), QueryTime(1e12+2000, 1e12+2050)), -1, true, func(kis KeyIdScore) bool {
+			res = append(res, kis)
+			return true
+		})
+		// 6 entries with timestamps and 100 entries without.
+		if len(res) != 106 || res[0].Time != 1e12+2050 || res[len(res)-1].Time != 0 {
+			t.Fatal(len(res), res[0])
+		}
+		// Second slot is fully timestamped and skipped.
+		if jm.Slots[1].Scans != 0 {
+			t.Fatal(jm)
+		}
+	}
+}
+
+func TestOpenIndexed(t *testing.T) {
+	b := New(0)
+	for i := 0; i < slotSize*3; i++ {
+		b.AddAt(Uint64Key(uint64(i)), []uint64{uint64(i % 100), 1000 + uint64(i/100)}, int64(i))
+	}
+	b.DeleteById(5)
+
+	dir := t.TempDir()
+	if _, err := b.Save(dir+"/a", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Save(dir+"/b", true); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(b *Range, v uint64) (res []KeyIdScore, jm JoinMetrics) {
+		jm = b.Join(Values{Exact: []uint64{v}}, -1, true, func(kis KeyIdScore) bool {
+			res = append(res, kis)
+			return true
+		})
+		return
+	}
+
+	for _, fn := range []string{"a", "b"} {
+		b2, err := Open(dir + "/" + fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b2.mapping == nil || b2.slots[0].raw == nil || b2.slots[0].rawLZ4 != (fn == "b") {
+			t.Fatal("not mapped")
+		}
+		if b2.Len() != b.Len() || b2.FirstKey() != b.FirstKey() || b2.LastKey() != b.LastKey() {
+			t.Fatal(b2.Len(), b2.LastKey())
+		}
+		res, _ := count(b2, 5)
+		if len(res) != (slotSize*3-5+99)/100-1 || res[0].Time != res[0].Id {
+			t.Fatal(len(res), res[0])
+		}
+
+		b2, _ = Open(dir + "/" + fn)
+		if res, _ := count(b2, 1300); len(res) != 100 {
+			t.Fatal(len(res))
+		}
+		if b2.slots[0].raw == nil || b2.slots[1].raw != nil || b2.slots[2].raw == nil {
+			// Only the slot containing 'i/100 == 300' should be decoded.
+			t.Fatal("lazy decoding")
+		}
+		if !b2.Add(Uint64Key(1e6), []uint64{1e6}) {
+			t.Fatal("add")
+		}
+		if res, _ := count(b2, 1e6); len(res) != 1 {
+			t.Fatal(res)
+		}
+	}
+
+	// Corrupted slot block.
+	buf := b.MarshalBinary(false)
+	buf[len(buf)-100]++
+	b3, err := Unmarshal(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, jm := count(b3, 5); jm.Slots[2].Err == nil || jm.Slots[1].Err != nil {
+		t.Fatal(jm)
+	}
+}
+
+type countReaderAt struct {
+	*bytes.Reader
+	reads int
+}
+
+func (r *countReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	return r.Reader.ReadAt(p, off)
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	b := New(0)
+	for i := 0; i < slotSize*3; i++ {
+		b.Add(Uint64Key(uint64(i)), []uint64{uint64(i % 100), 1000 + uint64(i/100)})
+	}
+	buf := b.MarshalBinary(true)
+	if buf[0]&fmtLZ4 == 0 || buf[0]&fmtIndexed == 0 {
+		t.Fatal(buf[0])
+	}
+	if raw := b.MarshalBinary(false); len(buf) >= len(raw) {
+		t.Fatal(len(buf), len(raw))
+	}
+
+	rd := &countReaderAt{Reader: bytes.NewReader(buf)}
+	b2, err := OpenReaderAt(rd, int64(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.reads != 2 {
+		t.Fatal(rd.reads)
+	}
+
+	var res []KeyIdScore
+	b2.Join(Values{Exact: []uint64{1300}}, -1, true, func(kis KeyIdScore) bool {
+		res = append(res, kis)
+		return true
+	})
+	if len(res) != 100 || res[0].Id != 30099 {
+		t.Fatal(res)
+	}
+	// Only the slot containing 'i/100 == 300' should be read.
+	if rd.reads != 3 {
+		t.Fatal(rd.reads)
+	}
+
+	// Corrupted compressed block.
+	buf[len(buf)-100]++
+	b3, err := OpenReaderAt(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jm := b3.Join(Values{Exact: []uint64{5}}, -1, true, func(KeyIdScore) bool { return true })
+	if jm.Slots[2].Err == nil || jm.Slots[1].Err != nil {
+		t.Fatal(jm)
+	}
+
+	if _, err := OpenReaderAt(bytes.NewReader(buf[:100]), 100); err == nil {
+		t.Fatal("short header")
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa := m.Saver().SetCheckpointInterval(time.Hour)
+	base := sa.Range().Start()
+
+	// The first batch is checkpointed, the rest are only logged.
+	for i := 0; i < 10; i++ {
+		if err := sa.Add(Uint64Key(uint64(i)), []uint64{uint64(i), 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b, _ := Load(m.getPath(base)); b == nil || b.Len() != 1 {
+		t.Fatal(b)
+	}
+
+	// Torn write at the end of the log.
+	f, err := os.OpenFile(m.getPath(base)+".wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	f.Close()
+
+	// Reopen without closing, as if the process crashed.
+	m2, err := NewManager(dir, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := m2.Saver().Range()
+	if b.Start() != base || b.Len() != 10 {
+		t.Fatal(b.Start(), base, b.Len())
+	}
+	if _, err := os.Stat(m.getPath(base) + ".wal"); err != nil {
+		t.Fatal(err)
+	}
+	var res []KeyIdScore
+	b.Join(Values{Exact: []uint64{100}}, -1, true, func(kis KeyIdScore) bool {
+		res = append(res, kis)
+		return true
+	})
+	if len(res) != 10 || res[0].Key != Uint64Key(9) || res[0].Id != base+9 {
+		t.Fatal(res)
+	}
+
+	// Replaying again won't duplicate entries.
+	w, _ := OpenWAL(t.TempDir() + "/x.wal")
+	w.append(9, []*aggTask{{key: Uint64Key(9), values: []uint64{9}}, {key: Uint64Key(10), values: []uint64{10}}})
+	if n, err := w.Replay(b); n != 1 || err != nil || b.Len() != 11 {
+		t.Fatal(n, err, b.Len())
+	}
+	if n, err := w.Replay(b); n != 0 || err != nil || b.Len() != 11 {
+		t.Fatal(n, err, b.Len())
+	}
+
+	m2.Close()
+	if _, err := os.Stat(m.getPath(base) + ".wal"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveIncremental(t *testing.T) {
+	path := t.TempDir() + "/r"
+	b := New(0)
+	for i := 0; i < 100; i++ {
+		b.AddAt(Uint64Key(uint64(i)), []uint64{uint64(i % 10), 100}, int64(i+1))
+	}
+	base, err := b.Save(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 100; i < 150; i++ {
+		b.AddAt(Uint64Key(uint64(i)), []uint64{uint64(i % 10), 100}, int64(i+1))
+	}
+	b.DeleteById(3)
+	n, err := b.SaveIncremental(path, false)
+	if err != nil || n <= 0 || n >= base {
+		t.Fatal(n, base, err)
+	}
+	if st, _ := os.Stat(path); st.Size() != int64(base+n) {
+		t.Fatal(st.Size(), base+n)
+	}
+	if n, _ := b.SaveIncremental(path, false); n != 0 {
+		t.Fatal(n)
+	}
+
+	check := func(b2 *Range, n int64) {
+		if b2.Len() != n || !b2.fastTable.Equals(b.fastTable) && n == b.Len() {
+			t.Fatal(b2.Len(), n)
+		}
+		var res []KeyIdScore
+		b2.Join(Values{Exact: []uint64{3}}, -1, true, func(kis KeyIdScore) bool {
+			res = append(res, kis)
+			return true
+		})
+		if len(res) != int(n/10)-1 || res[0].Time != n-6 || res[len(res)-1].Id != 13 {
+			t.Fatal(res)
+		}
+	}
+	b2, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b2, 150)
+	b2, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b2, 150)
+
+	// Torn segment at the end is discarded.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+	f.Close()
+	b2, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b2, 150)
+	for i := 150; i < 160; i++ {
+		b2.AddAt(Uint64Key(uint64(i)), []uint64{uint64(i % 10), 100}, int64(i+1))
+	}
+	if _, err := b2.SaveIncremental(path, false); err != nil {
+		t.Fatal(err)
+	}
+	b3, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b3, 160)
+
+	// Segments are merged by a full save periodically.
+	for i := 0; i <= maxSegments; i++ {
+		b3.Add(Uint64Key(uint64(1000+i)), []uint64{1000})
+		if _, err := b3.SaveIncremental(path, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st, _ := os.Stat(path); b3.seg.count >= maxSegments || st.Size() != b3.seg.size {
+		t.Fatal(b3.seg.count)
+	}
+	if b4, _ := Load(path); b4.Len() != b3.Len() || !b4.fastTable.Equals(b3.fastTable) {
+		t.Fatal(b4.Len())
+	}
+
+	// Files with torn segments are replaced, mapped ranges still see the old file.
+	b4, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, _ := os.Stat(path)
+	f, _ = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+	f.Close()
+	b4.Add(Uint64Key(2000), []uint64{1000})
+	if n, err := b4.SaveIncremental(path, false); err != nil || int64(n) != b4.seg.size {
+		t.Fatal(n, err)
+	}
+	if st2, _ := os.Stat(path); os.SameFile(st, st2) || st2.Size() != b4.seg.size {
+		t.Fatal(st2.Size())
+	}
+	if b5, _ := Open(path); b5.Len() != b4.Len() || !b5.Contains(Uint64Key(1000)) || !b4.Contains(Uint64Key(1000)) {
+		t.Fatal(b5.Len(), b4.Len())
+	}
+}
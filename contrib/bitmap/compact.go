@@ -0,0 +1,128 @@
+package bitmap
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/coyove/sdss/contrib/roaring"
+)
+
+// IdMapping translates ids of a range before compaction into ids after it.
+type IdMapping struct {
+	base    int64
+	removed *roaring.Bitmap
+}
+
+// Map returns the new id of 'id', false if the entry has been removed by compaction.
+func (im *IdMapping) Map(id int64) (int64, bool) {
+	offset := id - im.base
+	if offset < 0 || offset > math.MaxUint32 {
+		return id, false
+	}
+	if im.removed.Contains(uint32(offset)) {
+		return 0, false
+	}
+	return id - int64(im.removed.Rank(uint32(offset))), true
+}
+
+// Removed returns the number of entries dropped by compaction.
+func (im *IdMapping) Removed() int64 {
+	return int64(im.removed.GetCardinality())
+}
+
+func (b *Range) DeadLen() (n int64) {
+	for _, m := range b.slots {
+		m.ensure()
+		m.mu.RLock()
+		n += m.deadCount(0, int64(len(m.keys))-1)
+		m.mu.RUnlock()
+	}
+	return
+}
+
+// Compact returns a copy of the range with tombstoned entries and entries
+// matched by 'expired' (can be nil) physically removed. Remaining entries
+// are renumbered continuously from the range start.
+//
+// Original values are not stored, so fast table bits of a new fast slot are
+// the union of bits of all old fast slots contributing entries to it, which
+// preserves the no-false-negative property at the cost of some precision.
+func (b *Range) Compact(expired func(KeyIdScore) bool) (*Range, *IdMapping) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	n := newRange(b.start, b.Options())
+	n.storeValues = b.storeValues
+	im := &IdMapping{base: b.start, removed: roaring.New()}
+	var remap [fastSlotNum][]uint16
+
+	for hr, m := range b.slots {
+		m.ensure()
+		m.mu.RLock()
+		for i, k := range m.keys {
+			offset := int64(hr)*b.slotSize + int64(i)
+			ts := m.timestamp(int64(i))
+			if m.isDead(int64(i)) || (expired != nil && expired(KeyIdScore{Key: k, Id: b.start + offset, Time: ts, Start: b.start})) {
+				im.removed.Add(uint32(offset))
+				continue
+			}
+			n.end++
+			n.slots[n.end/n.slotSize].append(k, m.xfs[m.prevSpan(int64(i)):m.spans[i]], m.rawValues(int64(i)), ts)
+
+			from, to := uint16(offset/b.fastSlotSize), uint16(n.end/n.fastSlotSize)
+			if r := remap[from]; len(r) == 0 || r[len(r)-1] != to {
+				remap[from] = append(r, to)
+			}
+		}
+		m.mu.RUnlock()
+	}
+
+	b.fastTable.Iterate(func(x uint32) bool {
+		for _, to := range remap[x&^fastSlotMask] {
+			n.fastTable.Add(x&fastSlotMask | uint32(to))
+		}
+		return true
+	})
+	n.fastTable.RunOptimize()
+	return n, im
+}
+
+// Compact rewrites the range starting at 'start' without tombstoned and expired entries.
+// The active range which is still receiving writes can't be compacted.
+func (m *Manager) Compact(start int64, expired func(KeyIdScore) bool) (*IdMapping, error) {
+	if m.readonly {
+		return nil, ErrReadOnly
+	}
+	m.mu.Lock()
+	active := m.current.Range().Start() == start
+	m.mu.Unlock()
+	if active {
+		return nil, fmt.Errorf("compact active range %d", start)
+	}
+
+	mu := m.rangeLock(start)
+	mu.Lock()
+	defer mu.Unlock()
+	b, err := m.load(start)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, fmt.Errorf("compact range %d: not found", start)
+	}
+
+	begin := time.Now()
+	nb, im := b.Compact(expired)
+	if im.Removed() == 0 {
+		return im, nil
+	}
+	if err := m.saveRange(nb); err != nil {
+		return nil, err
+	}
+	m.cache.Add(m.getPath(start), nb)
+	if m.Event.OnCompacted != nil {
+		m.Event.OnCompacted(start, im, time.Since(begin))
+	}
+	return im, nil
+}
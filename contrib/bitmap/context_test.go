@@ -0,0 +1,137 @@
+package bitmap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coyove/sdss/contrib/clock"
+)
+
+func TestJoinContext(t *testing.T) {
+	b := New(0)
+	for i := 0; i < slotSize*3; i++ {
+		b.Add(Uint64Key(uint64(i)), []uint64{1})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hits := 0
+	jm := b.JoinContext(ctx, Values{Exact: []uint64{1}}, -1, true, func(KeyIdScore) bool {
+		hits++
+		cancel()
+		return true
+	})
+	if jm.Err != context.Canceled || hits != slotSize {
+		t.Fatal(jm.Err, hits)
+	}
+	if jm := b.JoinContext(ctx, Values{Exact: []uint64{1}}, -1, true, func(KeyIdScore) bool {
+		t.Fatal("hit")
+		return true
+	}); jm.Err != context.Canceled {
+		t.Fatal(jm.Err)
+	}
+}
+
+func TestManagerContext(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 10, NewLRUCache(1e6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	fillManager(t, m, 0, 50, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res, jms, err := m.CollectSimpleContext(ctx, distinct{}, Values{Exact: []uint64{1}}, 100)
+	if err != nil || len(res) != 50 || len(jms) != 5 {
+		t.Fatal(err, len(res), len(jms))
+	}
+
+	cancel()
+	res, _, err = m.CollectSimpleContext(ctx, distinct{}, Values{Exact: []uint64{1}}, 100)
+	if err != context.Canceled || len(res) != 0 {
+		t.Fatal(err, res)
+	}
+
+	// Partial results.
+	ctx, cancel = context.WithCancel(context.Background())
+	res, _, err = m.CollectSimpleContext(ctx, dedupFunc(func(Key) bool {
+		cancel()
+		return true
+	}), Values{Exact: []uint64{1}}, 100)
+	if err != context.Canceled || len(res) != 10 {
+		t.Fatal(err, len(res))
+	}
+
+	// Cancelled loads are still cached.
+	first, _ := m.findNext(0)
+	m.cache.Remove(m.getPath(first))
+	if _, err := m.loadContext(ctx, first); err != context.Canceled {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && !m.cache.contains(m.getPath(first)); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !m.cache.contains(m.getPath(first)) {
+		t.Fatal("not cached")
+	}
+}
+
+type dedupFunc func(Key) bool
+
+func (f dedupFunc) Add(k Key) bool { return f(k) }
+
+func TestMultiWalkDesc(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.Prefetch = 3
+	fillManager(t, m, 0, 10, nil)
+
+	var asc []int64
+	m.WalkDesc(clock.UnixMilli(), func(b *Range) bool {
+		asc = append(asc, b.Start())
+		return true
+	})
+	if len(asc) != 10 {
+		t.Fatal(asc)
+	}
+
+	var starts []int64
+	err = m.MultiWalkDesc(clock.UnixMilli(), func(b *Range) bool {
+		starts = append(starts, b.Start())
+		return true
+	})
+	if err != io.EOF || fmt.Sprint(starts) != fmt.Sprint(asc) {
+		t.Fatal(err, starts, asc)
+	}
+
+	starts = starts[:0]
+	err = m.MultiWalkDesc(clock.UnixMilli(), func(b *Range) bool {
+		starts = append(starts, b.Start())
+		return len(starts) < 4
+	})
+	if err != nil || fmt.Sprint(starts) != fmt.Sprint(asc[:4]) {
+		t.Fatal(err, starts)
+	}
+
+	// Errors stop the walk in order.
+	if err := os.WriteFile(filepath.Join(dir, m.getName(asc[5])), []byte{0xff}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	starts = starts[:0]
+	err = m.MultiWalkDesc(clock.UnixMilli(), func(b *Range) bool {
+		starts = append(starts, b.Start())
+		return true
+	})
+	if err == nil || err == io.EOF || fmt.Sprint(starts) != fmt.Sprint(asc[:5]) {
+		t.Fatal(err, starts)
+	}
+}
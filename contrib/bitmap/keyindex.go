@@ -0,0 +1,270 @@
+package bitmap
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/coyove/sdss/contrib/clock"
+	"github.com/coyove/sdss/contrib/simple"
+)
+
+// keyIndex maps keys to offsets of their entries in a range.
+type keyIndex struct {
+	mu   sync.RWMutex
+	ids  map[Key]int64   // offset of the first entry of each key
+	more map[Key][]int64 // offsets of other entries, only for keys added multiple times
+}
+
+func (x *keyIndex) add(k Key, off int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.ids[k]; !ok {
+		x.ids[k] = off
+	} else {
+		x.more[k] = append(x.more[k], off)
+	}
+}
+
+func (x *keyIndex) lookup(k Key) []int64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	first, ok := x.ids[k]
+	if !ok {
+		return nil
+	}
+	return append([]int64{first}, x.more[k]...)
+}
+
+// roughSizeBytes counts about 40 bytes per key: the key, its offset and the map
+// overhead, plus offsets of keys added multiple times.
+func (x *keyIndex) roughSizeBytes() (sz int64) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	sz = int64(len(x.ids)) * int64(KeySize+24)
+	for _, offs := range x.more {
+		sz += int64(KeySize+24) + int64(cap(offs))*8
+	}
+	return
+}
+
+// EnableKeyIndex builds an in-memory hash index of keys, so Find, Contains and
+// Delete don't need to scan all entries. The index costs about 40 bytes per entry
+// and is maintained by AddAt afterward.
+func (b *Range) EnableKeyIndex() {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.keyIndex() != nil {
+		return
+	}
+	x := &keyIndex{ids: map[Key]int64{}, more: map[Key][]int64{}}
+	for hr, m := range b.slots {
+		m.ensure()
+		m.mu.RLock()
+		for i, k := range m.keys {
+			x.add(k, int64(hr)*b.slotSize+int64(i))
+		}
+		m.mu.RUnlock()
+	}
+	b.idxmu.Lock()
+	b.index = x
+	b.idxmu.Unlock()
+}
+
+func (b *Range) keyIndex() *keyIndex {
+	b.idxmu.Lock()
+	defer b.idxmu.Unlock()
+	return b.index
+}
+
+// candidates returns offsets of all entries of key in ascending order, indexed will
+// be false if the range has no index, so all entries must be scanned.
+func (b *Range) candidates(key Key) (offs []int64, indexed bool) {
+	if x := b.keyIndex(); x != nil {
+		return x.lookup(key), true
+	}
+	return nil, false
+}
+
+// Contains returns whether key has live entries in the range.
+func (b *Range) Contains(key Key) bool {
+	_, ok := b.findOffset(key)
+	return ok
+}
+
+// findOffset returns the offset of the first live entry of key.
+func (b *Range) findOffset(key Key) (int64, bool) {
+	offs, indexed := b.candidates(key)
+	if !indexed {
+		for hr, m := range b.slots {
+			m.ensure()
+			m.mu.RLock()
+			for i, k := range m.keys {
+				if k == key && !m.isDead(int64(i)) {
+					m.mu.RUnlock()
+					return int64(hr)*b.slotSize + int64(i), true
+				}
+			}
+			m.mu.RUnlock()
+		}
+		return 0, false
+	}
+	for _, off := range offs {
+		m := b.slots[off/b.slotSize]
+		m.mu.RLock()
+		dead := m.isDead(off % b.slotSize)
+		m.mu.RUnlock()
+		if !dead {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// keyHash hashes key for key filters.
+func keyHash(k Key) uint64 {
+	return k.HighUint64()*0x9e3779b97f4a7c15 + k.LowUint64()
+}
+
+// keyFilter builds a xor filter of all keys in the range.
+func (b *Range) keyFilter() []byte {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var hs []uint64
+	for _, m := range b.slots {
+		m.ensure()
+		m.mu.RLock()
+		for _, k := range m.keys {
+			hs = append(hs, keyHash(k))
+		}
+		m.mu.RUnlock()
+	}
+	if len(hs) == 0 {
+		return nil
+	}
+	return xfNew(simple.Uint64.Dedup(hs))
+}
+
+func (m *Manager) getKeysName(base int64) string {
+	return m.getName(base) + ".keys"
+}
+
+// saveKeyFilter writes the key filter of a finished range as a sidecar file.
+func (m *Manager) saveKeyFilter(b *Range) error {
+	xf := b.keyFilter()
+	if xf == nil {
+		return nil
+	}
+	w, err := m.store.Create(m.getKeysName(b.Start()))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(xf); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	m.setKeyFilter(b.Start(), xf)
+	return nil
+}
+
+func (m *Manager) setKeyFilter(base int64, xf []byte) {
+	m.filtersmu.Lock()
+	defer m.filtersmu.Unlock()
+	if m.filters == nil {
+		m.filters = map[int64][]byte{}
+	}
+	m.filters[base] = xf
+}
+
+// mayContain tests key against the key filter of the range, it returns true if
+// the filter doesn't exist.
+func (m *Manager) mayContain(base int64, key Key) bool {
+	m.filtersmu.Lock()
+	xf, ok := m.filters[base]
+	m.filtersmu.Unlock()
+	if !ok {
+		r, err := m.store.Open(m.getKeysName(base))
+		if err == nil {
+			xf, err = ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			r.Close()
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return true
+			}
+			xf = nil
+		}
+		m.setKeyFilter(base, xf)
+	}
+	if len(xf) == 0 {
+		return true
+	}
+	x, vs := xfBuild(xf)
+	return xfContains(x, vs, keyHash(key))
+}
+
+// FindKey returns the newest range containing live entries of key and the id of
+// the first one, nil if not found. Finished ranges are tested by their key filters
+// before being loaded, ranges will be indexed if KeyIndex is set.
+func (m *Manager) FindKey(key Key) (*Range, int64, error) {
+	var found *Range
+	var id int64
+	err := m.walkKey(key, 0, func(b *Range) bool {
+		off, ok := b.findOffset(key)
+		if ok {
+			found, id = b, b.Start()+off
+		}
+		return !ok
+	})
+	return found, id, err
+}
+
+// walkKey is WalkDesc but skips ranges not containing key by their key filters.
+// Ranges starting before since (if not 0) and ranges provided by OnMissing in this
+// case are not walked.
+func (m *Manager) walkKey(key Key, since int64, f func(*Range) bool) error {
+	start := clock.UnixMilli()
+	for {
+		prev, isFirst := m.findPrev(start + 1)
+		if !isFirst && prev < since {
+			return nil
+		}
+		if isFirst {
+			if m.Event.OnMissing == nil || since != 0 {
+				return nil
+			}
+			// Older ranges are provided by OnMissing.
+			if err := m.WalkDesc(start, f); err != io.EOF {
+				return err
+			}
+			return nil
+		}
+		start = prev - 1
+		// The current range may have entries added after its key filter was saved.
+		if cur := m.currentRange(); (cur == nil || cur.Start() != prev) && !m.mayContain(prev, key) {
+			continue
+		}
+		b, err := m.load(prev)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			continue
+		}
+		if m.KeyIndex && b.keyIndex() == nil {
+			b.EnableKeyIndex()
+			// Update the weight of the cached range.
+			if fn := m.getPath(prev); m.cache.contains(fn) {
+				m.cache.Add(fn, b)
+			}
+		}
+		if !f(b) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package bitmap
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyIndex(t *testing.T) {
+	b := New(0)
+	for i := 0; i < slotSize+100; i++ {
+		b.Add(Uint64Key(uint64(i%(slotSize+50))), []uint64{uint64(i)})
+	}
+	find := func(k uint64) int64 {
+		id, f := b.Find(Uint64Key(k))
+		if f == nil {
+			return -1
+		}
+		if !f(uint64(id)) {
+			t.Fatal("filter", k, id)
+		}
+		return id
+	}
+	var before []int64
+	for k := uint64(0); k < slotSize+60; k++ {
+		before = append(before, find(k))
+	}
+	b.EnableKeyIndex()
+	for k := uint64(0); k < slotSize+60; k++ {
+		if id := find(k); id != before[k] {
+			t.Fatal(k, id, before[k])
+		}
+	}
+
+	if !b.Delete(Uint64Key(10)) || b.Contains(Uint64Key(10)) || b.Delete(Uint64Key(10)) {
+		t.Fatal("delete")
+	}
+	if !b.DeleteById(20) || find(20) != slotSize+70 {
+		t.Fatal(find(20))
+	}
+	b.Add(Uint64Key(10), []uint64{uint64(b.Len())})
+	if find(10) != b.Len()-1 {
+		t.Fatal(find(10))
+	}
+	if b.Contains(Uint64Key(slotSize + 60)) {
+		t.Fatal("contains")
+	}
+}
+
+func TestManagerFindKey(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	starts := fillManager(t, m, 0, 30, nil)
+	for _, s := range starts {
+		if _, err := os.Stat(filepath.Join(dir, m.getKeysName(s))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.files()) != 3 {
+		t.Fatal(m.files())
+	}
+
+	loads := 0
+	m.Event.OnLoaded = func(string, time.Duration) { loads++ }
+	for i := 0; i < 30; i++ {
+		b, id, err := m.FindKey(Uint64Key(uint64(i)))
+		if err != nil || b == nil || b.Start() != starts[i/10] || id != starts[i/10]+int64(i%10) {
+			t.Fatal(i, b, id, err)
+		}
+	}
+	loads = 0
+	if b, _, err := m.FindKey(Uint64Key(100)); b != nil || err != nil || loads != 0 {
+		t.Fatal(b, err, loads)
+	}
+
+	m.KeyIndex = true
+	if found, err := m.Delete(Uint64Key(5)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+	if b, _, _ := m.FindKey(Uint64Key(5)); b != nil {
+		t.Fatal(b)
+	}
+}
+
+func TestManagerFindKeyCurrent(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	sa := m.Saver()
+	var outs []chan error
+	for i := 0; i < 10; i++ {
+		outs = append(outs, sa.AddAsync(Uint64Key(uint64(i)), []uint64{1}))
+	}
+	for _, out := range outs {
+		if err := <-out; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, m.getKeysName(sa.Range().Start()))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Added after the key filter was saved, only logged in the WAL.
+	if err := sa.Add(Uint64Key(100), []uint64{1}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _, err := m.FindKey(Uint64Key(100)); b == nil || err != nil {
+		t.Fatal(b, err)
+	}
+	if found, err := m.Delete(Uint64Key(100)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+}
+
+func TestManagerKeyIndexCache(t *testing.T) {
+	cache := NewLRUCache(1e6)
+	m, err := NewManager(t.TempDir(), 10, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	starts := fillManager(t, m, 0, 30, nil)
+	if _, err := m.load(starts[0]); err != nil {
+		t.Fatal(err)
+	}
+	before := cache.curWeight
+
+	m.KeyIndex = true
+	if b, _, err := m.FindKey(Uint64Key(0)); b == nil || err != nil {
+		t.Fatal(b, err)
+	}
+	b, _ := m.load(starts[0])
+	if cache.curWeight <= before || b.RoughSizeBytes() != cache.cache[m.getPath(starts[0])].Value.(*entry).weight {
+		t.Fatal(before, cache.curWeight, b.RoughSizeBytes())
+	}
+}
+
+func TestManagerDeleteMissing(t *testing.T) {
+	m, err := NewManager(t.TempDir(), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	fillManager(t, m, 0, 10, nil)
+
+	old := New(1)
+	old.Add(Uint64Key(100), []uint64{1})
+	m.Event.OnMissing = func(start int64) (*Range, error) {
+		if start > old.Start() {
+			return old, nil
+		}
+		return nil, io.EOF
+	}
+	m.KeyIndex = true
+	if found, err := m.Delete(Uint64Key(100)); !found || err != nil || old.Contains(Uint64Key(100)) {
+		t.Fatal(found, err)
+	}
+}
@@ -9,6 +9,8 @@ type Cache struct {
 	maxWeight int64
 	curWeight int64
 
+	hits, misses, evictions int64
+
 	ll    *list.List
 	cache map[string]*list.Element
 
@@ -60,6 +62,7 @@ func (c *Cache) Add(key string, value *Range) {
 		c.ll.Remove(last)
 		c.curWeight -= last.Value.(*entry).weight
 		delete(c.cache, kv.key)
+		c.evictions++
 	}
 }
 
@@ -70,11 +73,31 @@ func (c *Cache) Get(key string) *Range {
 	if ele, hit := c.cache[key]; hit {
 		e := ele.Value.(*entry)
 		c.ll.MoveToFront(ele)
+		c.hits++
 		return e.value
 	}
+	c.misses++
 	return nil
 }
 
+func (c *Cache) Remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if ele, hit := c.cache[key]; hit {
+		c.ll.Remove(ele)
+		c.curWeight -= ele.Value.(*entry).weight
+		delete(c.cache, key)
+	}
+}
+
+func (c *Cache) contains(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, hit := c.cache[key]
+	return hit
+}
+
 func (c *Cache) Len() (len int) {
 	c.Lock()
 	len = c.ll.Len()
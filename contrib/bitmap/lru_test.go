@@ -29,3 +29,36 @@ func TestCache_Add(t *testing.T) {
 
 	fmt.Println(c.cache)
 }
+
+func TestRoughSizeMapped(t *testing.T) {
+	path := t.TempDir() + "/r"
+	b := New(0)
+	for i := 0; i < 20000; i++ {
+		b.Add(Uint64Key(uint64(i)), []uint64{uint64(i % 10), 100})
+	}
+	n, err := b.Save(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sz := b2.RoughSizeBytes(); sz < int64(n)/2 {
+		t.Fatal(sz, n)
+	}
+
+	// Slots are decoded while the size is being calculated.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			b2.RoughSizeBytes()
+		}
+		close(done)
+	}()
+	b2.Join(Values{Exact: []uint64{3}}, -1, true, func(KeyIdScore) bool { return true })
+	<-done
+	if sz := b2.RoughSizeBytes(); sz < int64(n)/2 {
+		t.Fatal(sz, n)
+	}
+}
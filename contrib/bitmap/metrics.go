@@ -0,0 +1,239 @@
+package bitmap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	latencyBuckets = []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5}
+	sizeBuckets    = []float64{1 << 10, 1 << 14, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26}
+	batchBuckets   = []float64{1, 10, 100, 1000, 10000}
+)
+
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64 // counts[i] is the number of observations <= bounds[i], the last one is +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) write(p *bytes.Buffer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var c int64
+	for i, b := range h.bounds {
+		c += h.counts[i]
+		fmt.Fprintf(p, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(b), c)
+	}
+	c += h.counts[len(h.bounds)]
+	fmt.Fprintf(p, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, c)
+	fmt.Fprintf(p, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(p, "%s_count{%s} %d\n", name, labels, c)
+}
+
+type managerStats struct {
+	load, save, saveBytes *histogram
+	batch, joinFast       *histogram
+
+	joins, scans, hits int64
+}
+
+func (m *Manager) stats() *managerStats {
+	m.statsOnce.Do(func() {
+		m.st = &managerStats{
+			load:      newHistogram(latencyBuckets),
+			save:      newHistogram(latencyBuckets),
+			saveBytes: newHistogram(sizeBuckets),
+			batch:     newHistogram(batchBuckets),
+			joinFast:  newHistogram(latencyBuckets),
+		}
+	})
+	return m.st
+}
+
+func (s *managerStats) observeSave(x int, err error, d time.Duration) {
+	if err == nil {
+		s.save.observe(d.Seconds())
+		s.saveBytes.observe(float64(x))
+	}
+}
+
+func (s *managerStats) observeJoins(jms []JoinMetrics) {
+	for _, jm := range jms {
+		var scans, hits int
+		for _, slot := range jm.Slots {
+			scans += slot.Scans
+			hits += slot.Hits
+		}
+		s.joinFast.observe(jm.FastElapsed.Seconds())
+		atomic.AddInt64(&s.joins, 1)
+		atomic.AddInt64(&s.scans, int64(scans))
+		atomic.AddInt64(&s.hits, int64(hits))
+	}
+}
+
+// Metrics exposes metrics of managers and caches in the Prometheus text format.
+type Metrics struct {
+	mu       sync.Mutex
+	managers []namedManager
+	caches   []namedCache
+}
+
+type namedManager struct {
+	name string
+	m    *Manager
+}
+
+type namedCache struct {
+	name string
+	c    *Cache
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// AddManager registers m with the label manager=name. Queries not made through
+// m (e.g.: Range.Join) are not counted.
+func (r *Metrics) AddManager(name string, m *Manager) *Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.managers = append(r.managers, namedManager{name, m})
+	return r
+}
+
+// AddCache registers c with the label cache=name, caches may be shared by managers
+// so they are registered separately.
+func (r *Metrics) AddCache(name string, c *Cache) *Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.caches = append(r.caches, namedCache{name, c})
+	return r
+}
+
+func (r *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+func (r *Metrics) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	managers := append([]namedManager{}, r.managers...)
+	caches := append([]namedCache{}, r.caches...)
+	r.mu.Unlock()
+
+	p := &bytes.Buffer{}
+	family := func(name, typ, help string) {
+		fmt.Fprintf(p, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	type cacheStats struct {
+		hits, misses, evictions, weight, entries int64
+	}
+	cs := make([]cacheStats, len(caches))
+	for i, c := range caches {
+		c.c.Lock()
+		cs[i] = cacheStats{c.c.hits, c.c.misses, c.c.evictions, c.c.curWeight, int64(c.c.ll.Len())}
+		c.c.Unlock()
+	}
+	for _, f := range []struct {
+		name, typ, help string
+		v               func(cacheStats) int64
+	}{
+		{"bitmap_cache_hits_total", "counter", "Number of cache hits.", func(s cacheStats) int64 { return s.hits }},
+		{"bitmap_cache_misses_total", "counter", "Number of cache misses.", func(s cacheStats) int64 { return s.misses }},
+		{"bitmap_cache_evictions_total", "counter", "Number of ranges evicted from the cache.", func(s cacheStats) int64 { return s.evictions }},
+		{"bitmap_cache_weight_bytes", "gauge", "Approximate size of cached ranges.", func(s cacheStats) int64 { return s.weight }},
+		{"bitmap_cache_entries", "gauge", "Number of cached ranges.", func(s cacheStats) int64 { return s.entries }},
+	} {
+		family(f.name, f.typ, f.help)
+		for i, c := range caches {
+			fmt.Fprintf(p, "%s{cache=\"%s\"} %d\n", f.name, escapeLabel(c.name), f.v(cs[i]))
+		}
+	}
+
+	labels := make([]string, len(managers))
+	for i, m := range managers {
+		labels[i] = fmt.Sprintf("manager=\"%s\"", escapeLabel(m.name))
+	}
+	for _, f := range []struct {
+		name, help string
+		h          func(*managerStats) *histogram
+	}{
+		{"bitmap_load_seconds", "Latency of loading ranges.", func(s *managerStats) *histogram { return s.load }},
+		{"bitmap_save_seconds", "Latency of saving ranges.", func(s *managerStats) *histogram { return s.save }},
+		{"bitmap_save_bytes", "Bytes written by saving ranges.", func(s *managerStats) *histogram { return s.saveBytes }},
+		{"bitmap_saver_batch_size", "Number of entries in batches of savers.", func(s *managerStats) *histogram { return s.batch }},
+		{"bitmap_join_fast_seconds", "Latency of fast table lookups of joins.", func(s *managerStats) *histogram { return s.joinFast }},
+	} {
+		family(f.name, "histogram", f.help)
+		for i, m := range managers {
+			f.h(m.m.stats()).write(p, f.name, labels[i])
+		}
+	}
+	for _, f := range []struct {
+		name, help string
+		v          func(*managerStats) *int64
+	}{
+		{"bitmap_joins_total", "Number of joins.", func(s *managerStats) *int64 { return &s.joins }},
+		{"bitmap_join_slot_scans_total", "Number of entries scanned by joins.", func(s *managerStats) *int64 { return &s.scans }},
+		{"bitmap_join_slot_hits_total", "Number of entries matched by joins.", func(s *managerStats) *int64 { return &s.hits }},
+	} {
+		family(f.name, "counter", f.help)
+		for i, m := range managers {
+			fmt.Fprintf(p, "%s{%s} %d\n", f.name, labels[i], atomic.LoadInt64(f.v(m.m.stats())))
+		}
+	}
+
+	family("bitmap_saver_queue_depth", "gauge", "Number of entries waiting in the saver.")
+	for i, m := range managers {
+		fmt.Fprintf(p, "bitmap_saver_queue_depth{%s} %d\n", labels[i], m.m.queueDepth())
+	}
+	family("bitmap_ranges", "gauge", "Number of range files.")
+	for i, m := range managers {
+		fmt.Fprintf(p, "bitmap_ranges{%s} %d\n", labels[i], len(m.m.files()))
+	}
+	return p.WriteTo(w)
+}
+
+func (m *Manager) queueDepth() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current == nil {
+		return 0
+	}
+	return m.current.QueueDepth()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
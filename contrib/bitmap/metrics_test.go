@@ -0,0 +1,59 @@
+package bitmap
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	cache := NewLRUCache(1e6)
+	m, err := NewManager(t.TempDir(), 10, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	fillManager(t, m, 0, 20, nil)
+	m.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+	m.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+
+	r := NewMetrics().AddManager(`m"1`, m).AddCache("c", cache)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	for _, line := range []string{
+		"# TYPE bitmap_cache_hits_total counter",
+		`bitmap_cache_hits_total{cache="c"} 1`,
+		`bitmap_cache_misses_total{cache="c"} 1`,
+		`bitmap_cache_entries{cache="c"} 1`,
+		`bitmap_joins_total{manager="m\"1"} 4`,
+		`bitmap_join_slot_hits_total{manager="m\"1"} 40`,
+		`bitmap_load_seconds_count{manager="m\"1"} 1`,
+		"# TYPE bitmap_saver_batch_size histogram",
+		`bitmap_saver_batch_size_sum{manager="m\"1"} 20`,
+		`bitmap_saver_queue_depth{manager="m\"1"} 0`,
+		`bitmap_ranges{manager="m\"1"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatal(line, "\n", out)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	for _, v := range []float64{0.5, 1, 2, 20} {
+		h.observe(v)
+	}
+	p := &bytes.Buffer{}
+	h.write(p, "x", `a="b"`)
+	if p.String() != `x_bucket{a="b",le="1"} 2
+x_bucket{a="b",le="10"} 3
+x_bucket{a="b",le="+Inf"} 4
+x_sum{a="b"} 23.5
+x_count{a="b"} 4
+` {
+		t.Fatal(p.String())
+	}
+}
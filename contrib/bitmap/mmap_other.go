@@ -0,0 +1,27 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package bitmap
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile falls back to reading the whole file into memory.
+type mmapFile struct {
+	data []byte
+}
+
+func mmapOpen(f *os.File) (*mmapFile, error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapFile{data: data}, nil
+}
+
+func (mf *mmapFile) close() error {
+	mf.data = nil
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package bitmap
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+type mmapFile struct {
+	data []byte
+}
+
+func mmapOpen(f *os.File) (*mmapFile, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() == 0 {
+		return &mmapFile{}, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(st.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	mf := &mmapFile{data: data}
+	runtime.SetFinalizer(mf, (*mmapFile).close)
+	return mf, nil
+}
+
+func (mf *mmapFile) close() error {
+	if mf.data == nil {
+		return nil
+	}
+	data := mf.data
+	mf.data = nil
+	runtime.SetFinalizer(mf, nil)
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,103 @@
+package bitmap
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Options configures the geometry of a range, zero fields take default values.
+// Sizes must be powers of 2. The geometry is recorded in the serialized header.
+type Options struct {
+	// SlotSize is the number of entries in a slot, slots are locked and lazily
+	// decoded individually. Offsets of filters in a slot are 32 bits, so it can be
+	// at most 1<<20, i.e.: 4KB filter per entry on average. Default: 16384.
+	SlotSize int
+
+	// SlotNum is the number of slots, the capacity of the range is SlotSize*SlotNum.
+	// Default: 64.
+	SlotNum int
+
+	// FastSlotSize is the number of entries covered by a bit of the fast table, it
+	// must not exceed SlotSize and a range can have at most 4096 fast slots.
+	// Smaller fast slots make joins scan fewer entries at the cost of a larger fast
+	// table. Default: 256.
+	FastSlotSize int
+
+	// HashNum is the number of fast table bits set by each value, 1 to 4. Default: 3.
+	HashNum int
+}
+
+func (o Options) normalize() (Options, error) {
+	if o.SlotSize == 0 {
+		o.SlotSize = slotSize
+	}
+	if o.SlotNum == 0 {
+		o.SlotNum = slotNum
+	}
+	if o.FastSlotSize == 0 {
+		o.FastSlotSize = fastSlotSize
+	}
+	if o.HashNum == 0 {
+		o.HashNum = bfHash
+	}
+	for _, x := range []int{o.SlotSize, o.SlotNum, o.FastSlotSize} {
+		if x <= 0 || x&(x-1) != 0 || x > 1<<30 {
+			return o, fmt.Errorf("invalid geometry %+v: sizes must be powers of 2", o)
+		}
+	}
+	if o.SlotSize > maxSlotSize {
+		return o, fmt.Errorf("invalid geometry %+v: slot is too large", o)
+	}
+	if o.FastSlotSize > o.SlotSize {
+		return o, fmt.Errorf("invalid geometry %+v: fast slot is larger than slot", o)
+	}
+	if o.SlotSize/o.FastSlotSize*o.SlotNum > fastSlotNum {
+		return o, fmt.Errorf("invalid geometry %+v: too many fast slots", o)
+	}
+	if o.HashNum < 1 || o.HashNum > 4 {
+		return o, fmt.Errorf("invalid geometry %+v: invalid hash num", o)
+	}
+	return o, nil
+}
+
+func (b *Range) setOptions(o Options) {
+	b.slotSize, b.fastSlotSize, b.hashNum = int64(o.SlotSize), int64(o.FastSlotSize), o.HashNum
+	b.slots = make([]*subMap, o.SlotNum)
+}
+
+// Options returns the geometry of the range.
+func (b *Range) Options() Options {
+	return Options{
+		SlotSize:     int(b.slotSize),
+		SlotNum:      len(b.slots),
+		FastSlotSize: int(b.fastSlotSize),
+		HashNum:      b.hashNum,
+	}
+}
+
+// Capacity returns the max number of entries of the range.
+func (b *Range) Capacity() int64 {
+	return b.slotSize * int64(len(b.slots))
+}
+
+// encodeGeometry returns log2 of SlotSize, SlotNum and FastSlotSize.
+func (o Options) encodeGeometry() []byte {
+	return []byte{
+		byte(bits.TrailingZeros(uint(o.SlotSize))),
+		byte(bits.TrailingZeros(uint(o.SlotNum))),
+		byte(bits.TrailingZeros(uint(o.FastSlotSize))),
+	}
+}
+
+// parseGeometry parses the geometry from the indexed header, ranges saved without
+// it have the default geometry.
+func parseGeometry(hdr []byte) (Options, error) {
+	o := Options{HashNum: int(hdr[17])}
+	if hdr[26]&hdrGeometry != 0 {
+		if hdr[27] > 30 || hdr[28] > 30 || hdr[29] > 30 {
+			return o, fmt.Errorf("invalid geometry %x", hdr[27:30])
+		}
+		o.SlotSize, o.SlotNum, o.FastSlotSize = 1<<hdr[27], 1<<hdr[28], 1<<hdr[29]
+	}
+	return o.normalize()
+}
@@ -0,0 +1,179 @@
+package bitmap
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOptions(t *testing.T) {
+	for _, o := range []Options{
+		{SlotSize: 1 << 20, FastSlotSize: 1 << 4},
+		{SlotSize: 1 << 21, SlotNum: 1, FastSlotSize: 1 << 21},
+		{SlotSize: 1 << 3, FastSlotSize: 1 << 4},
+		{SlotNum: 1 << 10},
+		{HashNum: 5},
+		{SlotSize: 100},
+	} {
+		if b, err := NewWithOptions(0, o); err == nil || b != nil {
+			t.Fatal(o)
+		}
+	}
+
+	path := t.TempDir() + "/r"
+	o := Options{SlotSize: 64, SlotNum: 8, FastSlotSize: 4, HashNum: 2}
+	b, err := NewWithOptions(0, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Capacity() != 512 || b.Options() != o {
+		t.Fatal(b.Options())
+	}
+	for i := 0; i < 600; i++ {
+		if ok := b.Add(Uint64Key(uint64(i)), []uint64{uint64(i % 10), 100}); ok != (i < 512) {
+			t.Fatal(i)
+		}
+	}
+	b.DeleteById(13)
+
+	check := func(b2 *Range) {
+		if b2.Options() != o || b2.Len() != 512 {
+			t.Fatal(b2.Options(), b2.Len())
+		}
+		var res []KeyIdScore
+		jm := b2.Join(Values{Exact: []uint64{3}}, -1, true, func(kis KeyIdScore) bool {
+			res = append(res, kis)
+			return true
+		})
+		if len(res) != 50 || res[0].Id != 503 || res[len(res)-1].Id != 3 || len(jm.Slots) != 8 {
+			t.Fatal(res)
+		}
+		var scans int
+		for _, s := range jm.Slots {
+			scans += s.Scans
+		}
+		if scans > 300 {
+			t.Fatal(scans)
+		}
+		res = res[:0]
+		b2.Join(Values{Oneof: []uint64{1}}, 100, false, func(kis KeyIdScore) bool {
+			res = append(res, kis)
+			return len(res) < 3
+		})
+		if len(res) != 3 || res[0].Id != 101 || res[2].Id != 121 {
+			t.Fatal(res)
+		}
+	}
+	check(b)
+	check(b.Clone())
+	for _, compress := range []bool{false, true} {
+		b2, err := Unmarshal(bytes.NewReader(b.MarshalBinary(compress)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(b2)
+	}
+	if _, err := b.Save(path, false); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b2)
+	b3, _ := b2.Compact(nil)
+	if b3.Options() != o || b3.Len() != 511 {
+		t.Fatal(b3.Options(), b3.Len())
+	}
+
+	// Ranges without geometry in the header have the default one.
+	hdr := b.MarshalBinary(false)
+	hdr[26] &^= hdrGeometry
+	if o2, err := parseGeometry(hdr); err != nil || o2 != (Options{slotSize, slotNum, fastSlotSize, 2}) {
+		t.Fatal(o2, err)
+	}
+}
+
+func TestManagerOptions(t *testing.T) {
+	o := Options{SlotSize: 64, SlotNum: 8, FastSlotSize: 4, HashNum: 2}
+	if _, err := NewManagerWithOptions(t.TempDir(), 513, nil, o); err == nil {
+		t.Fatal("switch limit")
+	}
+	if _, err := NewStorageManagerWithOptions(NewMemStorage(), 10, nil, Options{SlotSize: 100}); err == nil {
+		t.Fatal("options")
+	}
+
+	m, err := NewStorageManagerWithOptions(NewMemStorage(), 100, nil, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	srv := httptest.NewServer(m.ReplicationHandler())
+	defer srv.Close()
+	starts := fillManager(t, m, 0, 250, nil)
+	if len(starts) != 3 || m.Options() != o {
+		t.Fatal(starts, m.Options())
+	}
+
+	f, err := NewFollowerManager(NewMemStorage(), srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < 200; i++ {
+		if s, x := f.Position(); s == starts[2] && x == 50 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, mgr := range []*Manager{m, f} {
+		for _, s := range starts {
+			b, err := mgr.load(s)
+			if err != nil || b == nil || b.Options() != o {
+				t.Fatal(s, b, err)
+			}
+		}
+		res, _ := mgr.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 1000)
+		if len(res) != 250 {
+			t.Fatal(len(res))
+		}
+	}
+}
+
+func TestManagerReopenOptions(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManagerWithOptions(dir, 16, nil, Options{SlotSize: 8, SlotNum: 2, FastSlotSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillManager(t, m, 0, 10, nil)
+	m.Close()
+
+	// The reopened range is finished at its capacity.
+	m, err = NewManager(dir, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	add := func(from, to int) {
+		sa := m.Saver()
+		var outs []chan error
+		for i := from; i < to; i++ {
+			outs = append(outs, sa.AddAsync(Uint64Key(uint64(i)), []uint64{1}))
+		}
+		for _, out := range outs {
+			if err := <-out; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add(10, 16)
+	add(16, 40)
+	if b := m.Saver().Range(); b.Capacity() != slotSize*slotNum || b.Len() != 24 {
+		t.Fatal(b.Capacity(), b.Len())
+	}
+	if res, _ := m.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100); len(res) != 40 {
+		t.Fatal(len(res))
+	}
+}
@@ -0,0 +1,562 @@
+package bitmap
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/FastFilter/xorfilter"
+)
+
+type QueryOp byte
+
+const (
+	OpTerm QueryOp = iota
+	OpAnd
+	OpOr
+	OpNot
+	OpAtLeast
+	OpTime
+)
+
+// Query is a boolean expression over value hashes. Each matched Term
+// outside of a Not adds its weight to the score of an entry.
+type Query struct {
+	Op   QueryOp
+	Term uint64
+
+	// Weight of the node, constructors set it to 1 and it must not be negative. For
+	// Term it is the score contributed when matched, for other nodes it is only used
+	// by the parent AtLeast.
+	Weight float64
+
+	// N is the threshold of AtLeast: the sum of weights of matched children must reach N.
+	N float64
+
+	// Since and Until are the inclusive unix milli bounds of Time.
+	Since, Until int64
+
+	Raw      string
+	Children []*Query
+
+	// Explain makes joins fill KeyIdScore.Terms, it is only read from the root.
+	Explain bool
+}
+
+func QueryTerm(h uint64) *Query {
+	return &Query{Op: OpTerm, Term: h, Weight: 1}
+}
+
+func QueryAnd(qs ...*Query) *Query {
+	return &Query{Op: OpAnd, Children: qs, Weight: 1}
+}
+
+func QueryOr(qs ...*Query) *Query {
+	return &Query{Op: OpOr, Children: qs, Weight: 1}
+}
+
+func QueryNot(q *Query) *Query {
+	return &Query{Op: OpNot, Children: []*Query{q}, Weight: 1}
+}
+
+// QueryAtLeast matches when the sum of weights of matched qs is at least n,
+// which is simply "n of qs" when all weights are 1.
+func QueryAtLeast(n float64, qs ...*Query) *Query {
+	return &Query{Op: OpAtLeast, N: n, Children: qs, Weight: 1}
+}
+
+func (q *Query) weight() float64 {
+	return q.Weight
+}
+
+// validate returns an error if any weight in q is negative.
+func (q *Query) validate() (err error) {
+	q.walk(func(q *Query) {
+		if err == nil && !(q.Weight >= 0) {
+			err = fmt.Errorf("invalid query: negative weight %v of %v", q.Weight, q)
+		}
+	})
+	return err
+}
+
+// QueryTime matches entries added by Range.AddAt with timestamps within [since, until].
+// Entries without timestamps always match.
+func QueryTime(since, until int64) *Query {
+	return &Query{Op: OpTime, Since: since, Until: until, Weight: 1}
+}
+
+func queryTerms(hs []uint64, weight func(uint64) float64) (res []*Query) {
+	for _, h := range hs {
+		q := QueryTerm(h)
+		if weight != nil {
+			q.Weight = weight(h)
+		}
+		res = append(res, q)
+	}
+	return
+}
+
+// Query converts v into:
+// Or(Oneof...) AND AtLeast(majorScore, Major...) AND Exact... AND Not(Or(Exclude...))
+// Oneof and Exact terms weigh 0, so scores are the sum of weights of matched Major values.
+func (v Values) Query() *Query {
+	zero := func(uint64) float64 { return 0 }
+	var and []*Query
+	if len(v.Oneof) > 0 {
+		and = append(and, QueryOr(queryTerms(v.Oneof, zero)...))
+	}
+	if len(v.Major) > 0 {
+		and = append(and, QueryAtLeast(v.majorScore(), queryTerms(v.Major, v.weight)...))
+	}
+	and = append(and, queryTerms(v.Exact, zero)...)
+	if len(v.Exclude) > 0 {
+		and = append(and, QueryNot(QueryOr(queryTerms(v.Exclude, nil)...)))
+	}
+	var q *Query
+	switch len(and) {
+	case 0:
+		return nil
+	case 1:
+		q = and[0]
+	default:
+		q = QueryAnd(and...)
+	}
+	q.Explain = v.Explain
+	return q
+}
+
+// Terms returns Oneof, Major and Exact values in the order of scored terms of
+// Query(), which are indexed by KeyIdScore.Terms.
+func (v Values) Terms() []uint64 {
+	res := append([]uint64{}, v.Oneof...)
+	res = append(res, v.Major...)
+	return append(res, v.Exact...)
+}
+
+// TermSet is a bitset of indices of scored query terms, in the order of walking
+// the query tree, see Values.Terms.
+type TermSet []uint64
+
+func explainTerms(terms []uint64, contains func(uint64) bool) TermSet {
+	s := make(TermSet, (len(terms)+63)/64)
+	for i, t := range terms {
+		if contains(t) {
+			s[i/64] |= 1 << (i % 64)
+		}
+	}
+	return s
+}
+
+func (s TermSet) Contains(i int) bool {
+	return i >= 0 && i/64 < len(s) && s[i/64]&(1<<(i%64)) != 0
+}
+
+// Len returns the number of matched terms.
+func (s TermSet) Len() (n int) {
+	for _, w := range s {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+func (q *Query) walk(f func(*Query)) {
+	f(q)
+	for _, c := range q.Children {
+		c.walk(f)
+	}
+}
+
+// walkScored walks all terms which contribute to the score, i.e. terms not under Not.
+func (q *Query) walkScored(f func(*Query)) {
+	switch q.Op {
+	case OpTerm:
+		f(q)
+	case OpNot:
+	default:
+		for _, c := range q.Children {
+			c.walkScored(f)
+		}
+	}
+}
+
+// maxScore returns the highest score an entry can get from q.
+func (q *Query) maxScore() (s float64) {
+	if q != nil {
+		q.walkScored(func(t *Query) { s += t.weight() })
+	}
+	return
+}
+
+// fast evaluates the query against per-term fast bitmaps, the result is a superset of
+// fast slots containing matched entries. 'all' will be true if every fast slot may match,
+// e.g.: Not(...), because bloom bits can't prove the absence of a term.
+func (q *Query) fast(terms map[uint64]*bitmap1024) (res bitmap1024, all bool) {
+	switch q.Op {
+	case OpTerm:
+		return *terms[q.Term], false
+	case OpNot, OpTime:
+		return res, true
+	case OpAnd:
+		all = true
+		for _, c := range q.Children {
+			m, a := c.fast(terms)
+			if a {
+				continue
+			}
+			if all {
+				res, all = m, false
+			} else {
+				res.and(&m)
+			}
+		}
+		return res, all
+	case OpOr:
+		for _, c := range q.Children {
+			m, a := c.fast(terms)
+			if a {
+				return res, true
+			}
+			res.or(&m)
+		}
+		return res, false
+	case OpAtLeast:
+		need := q.N
+		var ms []bitmap1024
+		var ws []float64
+		for _, c := range q.Children {
+			m, a := c.fast(terms)
+			if a {
+				need -= c.weight()
+			} else {
+				ms, ws = append(ms, m), append(ws, c.weight())
+			}
+		}
+		if need <= 0 {
+			return res, true
+		}
+		var counts [fastSlotNum]float64
+		for i := range ms {
+			ms[i].iterate(func(offset uint16) bool {
+				if counts[offset] += ws[i]; counts[offset] >= need {
+					res.add(offset)
+				}
+				return true
+			})
+		}
+		return res, false
+	}
+	panic(fmt.Sprintf("invalid query op %d", q.Op))
+}
+
+// timeBounds returns the time bounds every matched entry must satisfy.
+func (q *Query) timeBounds() (since, until int64, ok bool) {
+	switch q.Op {
+	case OpTime:
+		return q.Since, q.Until, true
+	case OpAnd:
+		for _, c := range q.Children {
+			if s, u, ok2 := c.timeBounds(); ok2 {
+				if !ok || s > since {
+					since = s
+				}
+				if !ok || u < until {
+					until = u
+				}
+				ok = true
+			}
+		}
+	}
+	return
+}
+
+func (q *Query) match(xf xorfilter.Xor8, vs []uint32, ts int64) (ok bool, score float64) {
+	switch q.Op {
+	case OpTime:
+		return ts == 0 || (ts >= q.Since && ts <= q.Until), 0
+	case OpTerm:
+		if xfContains(xf, vs, q.Term) {
+			return true, q.weight()
+		}
+		return false, 0
+	case OpNot:
+		ok, _ := q.Children[0].match(xf, vs, ts)
+		return !ok, 0
+	case OpAnd:
+		for _, c := range q.Children {
+			ok, s := c.match(xf, vs, ts)
+			if !ok {
+				return false, 0
+			}
+			score += s
+		}
+		return true, score
+	case OpOr, OpAtLeast:
+		n, hit := 0.0, false
+		for _, c := range q.Children {
+			if ok, s := c.match(xf, vs, ts); ok {
+				n += c.weight()
+				score += s
+				hit = true
+			}
+		}
+		if q.Op == OpOr {
+			return hit, score
+		}
+		return n >= q.N, score
+	}
+	panic(fmt.Sprintf("invalid query op %d", q.Op))
+}
+
+func (q *Query) String() string {
+	if q == nil {
+		return "<empty>"
+	}
+	boost := ""
+	if q.Weight != 1 {
+		boost = "^" + strconv.FormatFloat(q.Weight, 'f', -1, 64)
+	}
+	if q.Raw != "" {
+		return strconv.Quote(q.Raw) + boost
+	}
+	switch q.Op {
+	case OpTerm:
+		return fmt.Sprintf("#%x", q.Term) + boost
+	case OpTime:
+		return fmt.Sprintf("TIME(%d, %d)", q.Since, q.Until) + boost
+	case OpNot:
+		return "NOT " + q.Children[0].String()
+	}
+	var parts []string
+	for _, c := range q.Children {
+		parts = append(parts, c.String())
+	}
+	switch q.Op {
+	case OpAnd:
+		return "(" + strings.Join(parts, " AND ") + ")" + boost
+	case OpOr:
+		return "(" + strings.Join(parts, " OR ") + ")" + boost
+	case OpAtLeast:
+		return fmt.Sprintf("ATLEAST(%v, %s)", q.N, strings.Join(parts, ", ")) + boost
+	}
+	return fmt.Sprintf("<invalid op %d>", q.Op)
+}
+
+// ParseQuery parses text into a query, the syntax is:
+//
+//	expr    := and ('OR' and)*
+//	and     := unary ('AND'? unary)*
+//	unary   := ('NOT' | '-') unary | primary
+//	primary := ('(' expr ')' | 'ATLEAST' '(' number (',' expr)+ ')' | word | '"' quoted '"') ('^' weight)?
+//
+// Operators are case sensitive, 'hash' maps a term to one or more value hashes
+// which must all match, e.g.: ngram hashes of a word.
+func ParseQuery(text string, hash func(string) []uint64) (*Query, error) {
+	p := &queryParser{hash: hash}
+	if err := p.tokenize(text); err != nil {
+		return nil, err
+	}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("parse query: unexpected %q", p.tokens[p.pos].text)
+	}
+	return q, nil
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+type queryParser struct {
+	hash   func(string) []uint64
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) tokenize(text string) error {
+	for i := 0; i < len(text); {
+		switch c := text[i]; c {
+		case ' ', '\t', '\r', '\n':
+			i++
+		case '(', ')', ',', '-', '^':
+			p.tokens = append(p.tokens, queryToken{text: text[i : i+1]})
+			i++
+		case '"':
+			j := i + 1
+			for ; j < len(text) && text[j] != '"'; j++ {
+				if text[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(text) {
+				return fmt.Errorf("parse query: unclosed quote at %d", i)
+			}
+			s, err := strconv.Unquote(text[i : j+1])
+			if err != nil {
+				return fmt.Errorf("parse query: %v", err)
+			}
+			p.tokens = append(p.tokens, queryToken{text: s, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(text) && !strings.ContainsRune(" \t\r\n(),\"^", rune(text[j])); j++ {
+			}
+			p.tokens = append(p.tokens, queryToken{text: text[i:j]})
+			i = j
+		}
+	}
+	return nil
+}
+
+func (p *queryParser) peek(op string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == op
+}
+
+func (p *queryParser) expect(op string) error {
+	if !p.peek(op) {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("parse query: expect %q, got EOF", op)
+		}
+		return fmt.Errorf("parse query: expect %q, got %q", op, p.tokens[p.pos].text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *queryParser) or() (*Query, error) {
+	q, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("OR") {
+		p.pos++
+		q2, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		if q.Op == OpOr {
+			q.Children = append(q.Children, q2)
+		} else {
+			q = QueryOr(q, q2)
+		}
+	}
+	return q, nil
+}
+
+func (p *queryParser) and() (*Query, error) {
+	q, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.pos < len(p.tokens) && !p.peek("OR") && !p.peek(")") && !p.peek(",") {
+		if p.peek("AND") {
+			p.pos++
+		}
+		q2, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if q.Op == OpAnd && q.Raw == "" {
+			q.Children = append(q.Children, q2)
+		} else {
+			q = QueryAnd(q, q2)
+		}
+	}
+	return q, nil
+}
+
+func (p *queryParser) unary() (*Query, error) {
+	if p.peek("NOT") || p.peek("-") {
+		p.pos++
+		q, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return QueryNot(q), nil
+	}
+	q, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek("^") {
+		p.pos++
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("parse query: missing weight")
+		}
+		w, err := strconv.ParseFloat(p.tokens[p.pos].text, 64)
+		if err != nil || !(w >= 0) {
+			return nil, fmt.Errorf("parse query: invalid weight %q", p.tokens[p.pos].text)
+		}
+		p.pos++
+		if q.Op == OpAnd && q.Raw != "" {
+			// Multi-hash term, spread the weight over its hashes.
+			for _, c := range q.Children {
+				c.Weight = w / float64(len(q.Children))
+			}
+		}
+		q.Weight = w
+	}
+	return q, nil
+}
+
+func (p *queryParser) primary() (*Query, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("parse query: unexpected EOF")
+	}
+	switch {
+	case p.peek("("):
+		p.pos++
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return q, p.expect(")")
+	case p.peek("ATLEAST"):
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("parse query: ATLEAST: missing number")
+		}
+		n, err := strconv.ParseFloat(p.tokens[p.pos].text, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("parse query: ATLEAST: invalid number %q", p.tokens[p.pos].text)
+		}
+		p.pos++
+		q := QueryAtLeast(n)
+		for p.peek(",") {
+			p.pos++
+			c, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			q.Children = append(q.Children, c)
+		}
+		if len(q.Children) == 0 {
+			return nil, fmt.Errorf("parse query: ATLEAST: empty operands")
+		}
+		return q, p.expect(")")
+	case p.peek(")"), p.peek(","), p.peek("AND"), p.peek("OR"), p.peek("^"):
+		return nil, fmt.Errorf("parse query: unexpected %q", p.tokens[p.pos].text)
+	}
+
+	raw := p.tokens[p.pos].text
+	p.pos++
+	hs := p.hash(raw)
+	if len(hs) == 0 {
+		return nil, fmt.Errorf("parse query: term %q has no hash", raw)
+	}
+	if len(hs) == 1 {
+		q := QueryTerm(hs[0])
+		q.Raw = raw
+		return q, nil
+	}
+	q := QueryAnd(queryTerms(hs, nil)...)
+	q.Raw = raw
+	return q, nil
+}
@@ -0,0 +1,216 @@
+package bitmap
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	hash := func(s string) []uint64 {
+		v, _ := strconv.ParseUint(s, 10, 64)
+		return []uint64{v}
+	}
+
+	for _, c := range [][2]string{
+		{"1 2 OR 3", `(("1" AND "2") OR "3")`},
+		{"(1 OR 2) AND NOT 3 ATLEAST(2, 4, 5, 6)", `(("1" OR "2") AND NOT "3" AND ATLEAST(2, "4", "5", "6"))`},
+		{`-"7" (8)`, `(NOT "7" AND "8")`},
+		{`ATLEAST(1.5, 1^0.5, (2 3)^2)`, `ATLEAST(1.5, "1"^0.5, ("2" AND "3")^2)`},
+	} {
+		q, err := ParseQuery(c[0], hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.String() != c[1] {
+			t.Fatal(c[0], q.String())
+		}
+	}
+	for _, bad := range []string{"", "(1", "1 OR", "ATLEAST(x, 1)", "ATLEAST(1)", `"1`, "1 )", "1^", "1^x", "^2"} {
+		if _, err := ParseQuery(bad, hash); err == nil {
+			t.Fatal(bad)
+		}
+	}
+
+	// Entry i contains values of its decimal digits.
+	b := New(0)
+	digits := func(i int) (res []uint64) {
+		for _, c := range strconv.Itoa(i) {
+			res = append(res, uint64(c-'0'))
+		}
+		return
+	}
+	for i := 0; i < 20000; i++ {
+		b.Add(Uint64Key(uint64(i)), digits(i))
+	}
+
+	q, _ := ParseQuery("(1 OR 2) AND NOT 3 ATLEAST(2, 4, 5, 6)", hash)
+	expect := map[int64]float64{}
+	for i := 0; i < 20000; i++ {
+		has := map[uint64]bool{}
+		for _, d := range digits(i) {
+			has[d] = true
+		}
+		n := 0
+		for _, d := range []uint64{4, 5, 6} {
+			if has[d] {
+				n++
+			}
+		}
+		if (has[1] || has[2]) && !has[3] && n >= 2 {
+			s := n
+			if has[1] {
+				s++
+			}
+			if has[2] {
+				s++
+			}
+			expect[int64(i)] = float64(s)
+		}
+	}
+
+	found := 0
+	b.JoinQuery(q, -1, true, func(kis KeyIdScore) bool {
+		found++
+		if s, ok := expect[kis.Id]; !ok || s != kis.Score {
+			t.Fatal(kis, s)
+		}
+		return true
+	})
+	if found != len(expect) {
+		t.Fatal(found, len(expect))
+	}
+}
+
+func TestQueryWeights(t *testing.T) {
+	b := New(0)
+	for i := 0; i < 1000; i++ {
+		var v []uint64
+		for j := 0; j < 4; j++ {
+			if i&(1<<j) > 0 {
+				v = append(v, uint64(j))
+			}
+		}
+		b.Add(Uint64Key(uint64(i)), append(v, 100))
+	}
+
+	vs := Values{
+		Major:    []uint64{0, 1, 2, 3},
+		Weights:  map[uint64]float64{0: 0.5, 1: 1, 2: 2, 3: 4},
+		MinScore: 4.5,
+	}
+	n := 0
+	b.Join(vs, -1, true, func(kis KeyIdScore) bool {
+		exp := 0.0
+		for j := 0; j < 4; j++ {
+			if kis.Id&(1<<j) > 0 {
+				exp += vs.Weights[uint64(j)]
+			}
+		}
+		if exp < 4.5 || exp != kis.Score {
+			t.Fatal(kis, exp)
+		}
+		n++
+		return true
+	})
+	// Weight 4 must be matched with at least one other value: 7 out of every 16 numbers.
+	if n != 1000/16*7 {
+		t.Fatal(n)
+	}
+
+	// No MinScore: 3 out of 4 major values, i.e. 75% of total weight 7.5.
+	vs.MinScore = 0
+	if s := vs.majorScore(); s != 7.5*3/4 {
+		t.Fatal(s)
+	}
+
+	// Only Major values are scored.
+	b.Join(Values{Oneof: []uint64{0, 1}, Major: []uint64{2}, Exact: []uint64{100}}, -1, true, func(kis KeyIdScore) bool {
+		if kis.Id&4 == 0 || kis.Score != 1 {
+			t.Fatal(kis)
+		}
+		return true
+	})
+
+	// Zero weights are kept, negative ones are rejected.
+	vs = Values{Major: []uint64{0, 1}, Weights: map[uint64]float64{0: 0}}
+	if s := vs.majorScore(); s != 1 {
+		t.Fatal(s)
+	}
+	n = 0
+	b.Join(vs, -1, true, func(kis KeyIdScore) bool {
+		if kis.Id&2 == 0 || kis.Score != 1 {
+			t.Fatal(kis)
+		}
+		n++
+		return true
+	})
+	if n != 500 {
+		t.Fatal(n)
+	}
+	vs.Weights[0] = -1
+	if jm := b.Join(vs, -1, true, func(KeyIdScore) bool { t.Fatal(); return false }); jm.Err == nil {
+		t.Fatal(jm)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	for _, stored := range []bool{false, true} {
+		b := New(0)
+		if stored {
+			b.EnableStoredValues()
+		}
+		b.Add(Uint64Key(0), []uint64{1, 2, 3})
+		b.Add(Uint64Key(1), []uint64{2, 4})
+		b.Add(Uint64Key(2), []uint64{1, 4, 5})
+
+		vs := Values{Oneof: []uint64{1, 2}, Major: []uint64{4, 5, 6}, Exclude: []uint64{3}, MinScore: 1, Explain: true}
+		res := map[Key]TermSet{}
+		jm := b.Join(vs, -1, true, func(kis KeyIdScore) bool {
+			res[kis.Key] = kis.Terms
+			return true
+		})
+		if terms := jm.Values.Terms(); len(terms) != 5 || terms[2] != 4 {
+			t.Fatal(terms)
+		}
+		if len(res) != 2 {
+			t.Fatal(res)
+		}
+		if s := res[Uint64Key(1)]; s.Len() != 2 || !s.Contains(1) || !s.Contains(2) {
+			t.Fatal(s)
+		}
+		if s := res[Uint64Key(2)]; s.Len() != 3 || !s.Contains(0) || !s.Contains(3) || s.Contains(4) {
+			t.Fatal(s)
+		}
+
+		vs.Explain = false
+		b.Join(vs, -1, true, func(kis KeyIdScore) bool {
+			if kis.Terms != nil {
+				t.Fatal(kis)
+			}
+			return true
+		})
+	}
+}
+
+func TestSearchExplain(t *testing.T) {
+	m, err := NewManager(t.TempDir(), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.StoredValues = true
+	fillManager(t, m, 0, 10, func(i int) []uint64 { return []uint64{1, uint64(i % 2)} })
+
+	vs := Values{Major: []uint64{0, 1}, MinScore: 1, Explain: true}
+	res, _ := m.Search(vs, time.Time{}, time.Time{}, 100, nil)
+	if len(res) != 10 {
+		t.Fatal(len(res))
+	}
+	for _, kis := range res {
+		odd := kis.Key.LowUint64()%2 == 1
+		if s := kis.Terms; s.Contains(0) == odd || !s.Contains(1) || len(kis.Matched) != s.Len() {
+			t.Fatal(kis)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package bitmap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ErrReadOnly = fmt.Errorf("read-only replica")
+
+// NewReplicaManager creates a read-only manager serving ranges written by a primary
+// manager to s. It never creates a saver, and polls s every interval to pick up
+// new ranges and drop cached ranges whose files changed. The staleness is bounded
+// by the interval plus the checkpoint interval of the primary, since adds only
+// recorded in its WAL are not visible.
+func NewReplicaManager(s Storage, interval time.Duration, cache *Cache) (*Manager, error) {
+	if cache == nil {
+		cache = NewLRUCache(0)
+	}
+	m := &Manager{
+		store:    s,
+		cache:    cache,
+		readonly: true,
+		versions: map[int64][2]int64{},
+		stop:     make(chan struct{}),
+	}
+	if err := m.ReloadFiles(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go m.follow(interval)
+	}
+	return m, nil
+}
+
+func (m *Manager) follow(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-tick.C:
+			m.Refresh()
+		}
+	}
+}
+
+func (m *Manager) stopFollow() {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+}
+
+// Refresh reloads the file list of a replica and invalidates cached ranges whose
+// files changed since they were loaded.
+func (m *Manager) Refresh() error {
+	if err := m.ReloadFiles(); err != nil {
+		return err
+	}
+
+	m.versionsmu.Lock()
+	bases := make([]int64, 0, len(m.versions))
+	for base := range m.versions {
+		bases = append(bases, base)
+	}
+	m.versionsmu.Unlock()
+
+	for _, base := range bases {
+		fn := m.getPath(base)
+		if !m.cache.contains(fn) {
+			continue
+		}
+		v, err := storageVersion(m.store, m.getName(base))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		m.versionsmu.Lock()
+		changed := err != nil || v != m.versions[base]
+		m.versionsmu.Unlock()
+		if changed {
+			m.unwatch(base)
+			m.cache.Remove(fn)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) watch(base int64) {
+	v, err := storageVersion(m.store, m.getName(base))
+	if err != nil {
+		return
+	}
+	m.versionsmu.Lock()
+	m.versions[base] = v
+	m.versionsmu.Unlock()
+}
+
+func (m *Manager) unwatch(base int64) {
+	m.versionsmu.Lock()
+	delete(m.versions, base)
+	m.versionsmu.Unlock()
+}
+
+// storageVersion returns the size and the modification time (if available) of name.
+func storageVersion(s Storage, name string) (v [2]int64, err error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return v, err
+	}
+	defer r.Close()
+	v[0] = r.Size()
+	if mt, ok := r.(interface{ ModTime() time.Time }); ok {
+		v[1] = mt.ModTime().UnixNano()
+	}
+	return v, nil
+}
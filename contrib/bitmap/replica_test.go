@@ -0,0 +1,76 @@
+package bitmap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplica(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(from, to int) {
+		var outs []chan error
+		sa := m.Saver().SetCheckpointInterval(0)
+		for i := from; i < to; i++ {
+			outs = append(outs, sa.AddAsync(Uint64Key(uint64(i)), []uint64{1}))
+		}
+		for _, out := range outs {
+			if err := <-out; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add(0, 10)
+	add(10, 15)
+
+	r, err := NewReplicaManager(Dir(dir), 0, NewLRUCache(1e6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Saver() != nil {
+		t.Fatal("saver")
+	}
+	if _, err := r.Delete(Uint64Key(1)); err != ErrReadOnly {
+		t.Fatal(err)
+	}
+	count := func(r *Manager) int {
+		res, _ := r.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+		return len(res)
+	}
+	if n := count(r); n != 15 {
+		t.Fatal(n)
+	}
+
+	// Cached ranges are served until refreshed.
+	add(15, 18)
+	if n := count(r); n != 15 {
+		t.Fatal(n)
+	}
+	r.Refresh()
+	if n := count(r); n != 18 {
+		t.Fatal(n)
+	}
+	if found, err := m.Delete(Uint64Key(3)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+	r.Refresh()
+	if n := count(r); n != 17 {
+		t.Fatal(n)
+	}
+
+	// Polling.
+	r2, err := NewReplicaManager(Dir(dir), 10*time.Millisecond, NewLRUCache(1e6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	count(r2)
+	add(18, 20)
+	time.Sleep(50 * time.Millisecond)
+	if n := count(r2); n != 19 {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,471 @@
+package bitmap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultFeedSize = 8 << 20
+
+var errFeedGone = fmt.Errorf("feed position is gone")
+
+// feed keeps recent batches accepted by the current ranges of a primary manager.
+// Records are the same as WAL records prefixed by the range start:
+//
+//	size(4) checksum(4) start(8) firstId(8) count(4) entries
+//
+// A stream of a finished range ends with a record containing no entries.
+type feed struct {
+	mu      sync.Mutex
+	batches []feedBatch
+	size    int
+	floor   map[int64]int64 // first id published for each range
+	ends    map[int64]int64 // id after the last published batch for each range
+	live    int64
+	notify  chan struct{}
+}
+
+type feedBatch struct {
+	start, firstId, end int64
+	data                []byte
+}
+
+func (f *feed) open(b *Range) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.floor == nil {
+		f.floor, f.ends = map[int64]int64{}, map[int64]int64{}
+	}
+	f.live = b.Start()
+	f.floor[b.Start()] = b.Len()
+	f.ends[b.Start()] = b.Len()
+	f.broadcast()
+}
+
+func (f *feed) broadcast() {
+	if f.notify != nil {
+		close(f.notify)
+	}
+	f.notify = make(chan struct{})
+}
+
+func (m *Manager) publish(b *Range, firstId int64, tasks []*aggTask) {
+	limit := m.FeedSize
+	if limit == 0 {
+		limit = DefaultFeedSize
+	}
+	var data []byte
+	if limit > 0 {
+		data = encodeRecord(startPrefix(b.Start()), firstId, tasks)
+	}
+
+	f := &m.feed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := firstId + int64(len(tasks))
+	f.ends[b.Start()] = end
+	if limit > 0 {
+		f.batches = append(f.batches, feedBatch{start: b.Start(), firstId: firstId, end: end, data: data})
+		f.size += len(data)
+	}
+	// The newest batch is always kept for followers which are catching up.
+	for len(f.batches) > 1 && f.size > limit {
+		f.size -= len(f.batches[0].data)
+		f.batches[0] = feedBatch{}
+		f.batches = f.batches[1:]
+	}
+	f.broadcast()
+}
+
+func startPrefix(start int64) []byte {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], uint64(start))
+	return p[:]
+}
+
+// ReplicationHandler serves ranges and the change feed of m to followers created by
+// NewFollowerManager. Batches are kept in memory up to FeedSize bytes, followers
+// falling behind will fetch whole ranges instead. Paths are:
+//
+//	/ranges                  starts of all ranges, one per line
+//	/snapshot?start=S        range S in indexed layout
+//	/feed?start=S&id=N       records of range S starting from id N
+//
+// Tombstones made by Manager.Delete and by upserts in older ranges, and compactions
+// are not replicated: followers keep returning these entries until they fetch the
+// ranges again, e.g.: after falling behind.
+func (m *Manager) ReplicationHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ranges", m.serveRanges)
+	mux.HandleFunc("/snapshot", m.serveSnapshot)
+	mux.HandleFunc("/feed", m.serveFeed)
+	return mux
+}
+
+func (m *Manager) serveRanges(w http.ResponseWriter, r *http.Request) {
+	m.feed.mu.Lock()
+	live := m.feed.live
+	m.feed.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain")
+	var last int64
+	for _, n := range m.files() {
+		last, _ = strconv.ParseInt(n, 16, 64)
+		fmt.Fprintln(w, last)
+	}
+	if live > last {
+		fmt.Fprintln(w, live)
+	}
+}
+
+func (m *Manager) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := m.load(start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	b.Marshal(w, false)
+}
+
+func (m *Manager) serveFeed(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	flusher, _ := w.(http.Flusher)
+	sent := false
+	fail := func(code int, msg string) {
+		// The stream is cut without the ending record if anything was sent.
+		if !sent {
+			http.Error(w, msg, code)
+		}
+	}
+	finish := func() {
+		w.Write(encodeRecord(startPrefix(start), id, nil))
+	}
+
+	for {
+		f := &m.feed
+		f.mu.Lock()
+		notify := f.notify
+		floor, known := f.floor[start]
+		end, live := f.ends[start], f.live == start
+		var out [][]byte
+		first := int64(-1)
+		for _, fb := range f.batches {
+			if fb.start == start && fb.end > id {
+				if first == -1 {
+					first = fb.firstId
+				}
+				out = append(out, fb.data)
+				end = fb.end
+			}
+		}
+		f.mu.Unlock()
+
+		switch {
+		case !known || id < floor:
+			// Entries added before the feed started.
+			b, err := m.load(start)
+			if err != nil {
+				fail(http.StatusInternalServerError, err.Error())
+				return
+			}
+			if b == nil {
+				fail(http.StatusNotFound, "range not found")
+				return
+			}
+			if known || id != b.Len() {
+				fail(http.StatusGone, errFeedGone.Error())
+				return
+			}
+			finish()
+			return
+		case len(out) > 0:
+			if first > id {
+				fail(http.StatusGone, errFeedGone.Error())
+				return
+			}
+			for _, data := range out {
+				if _, err := w.Write(data); err != nil {
+					return
+				}
+			}
+			id, sent = end, true
+			if flusher != nil {
+				flusher.Flush()
+			}
+			continue
+		case id < end:
+			fail(http.StatusGone, errFeedGone.Error())
+			return
+		case !live && id == end:
+			finish()
+			return
+		case !live:
+			fail(http.StatusBadRequest, fmt.Sprintf("id %d is beyond the end %d", id, end))
+			return
+		}
+
+		// Caught up with the live range, or the batch containing id is on the way.
+		if !sent {
+			w.WriteHeader(http.StatusOK)
+			sent = true
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// NewFollowerManager creates a read-only manager replicating ranges from the primary
+// serving ReplicationHandler at addr into s. Entries are applied to local ranges
+// and saved incrementally as they arrive, following resumes from the newest local
+// range after restarting, see Position.
+func NewFollowerManager(s Storage, addr string, cache *Cache) (*Manager, error) {
+	m, err := NewReplicaManager(s, 0, cache)
+	if err != nil {
+		return nil, err
+	}
+	go m.replicate(addr)
+	return m, nil
+}
+
+// Position returns the range and the id a follower is going to receive next.
+func (m *Manager) Position() (start, id int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tail == nil {
+		return 0, 0
+	}
+	m.tail.mu.RLock()
+	defer m.tail.mu.RUnlock()
+	return m.tail.Start(), m.tail.Len()
+}
+
+func (m *Manager) tailRange(start int64) *Range {
+	if !m.readonly {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tail != nil && m.tail.Start() == start {
+		return m.tail
+	}
+	return nil
+}
+
+func (m *Manager) setTail(b *Range) {
+	m.mu.Lock()
+	m.tail = b
+	m.mu.Unlock()
+	m.cache.Remove(m.getPath(b.Start()))
+}
+
+const followRetry = time.Second
+
+func (m *Manager) replicate(addr string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-m.stop
+		cancel()
+	}()
+	for {
+		n, err := m.replicateOnce(ctx, addr)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil || n == 0 {
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(followRetry):
+			}
+		}
+	}
+}
+
+func (m *Manager) replicateOnce(ctx context.Context, addr string) (n int, err error) {
+	resp, err := m.get(ctx, addr, "/ranges", nil)
+	if err != nil {
+		return 0, err
+	}
+	var starts []int64
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		s, err := strconv.ParseInt(sc.Text(), 10, 64)
+		if err != nil {
+			resp.Body.Close()
+			return 0, err
+		}
+		starts = append(starts, s)
+	}
+	resp.Body.Close()
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+
+	last, ok := m.Last()
+	if s, _ := m.Position(); s > last {
+		last, ok = s, true
+	}
+	for _, s := range starts {
+		if ok && s < last {
+			continue
+		}
+		x, err := m.followRange(ctx, addr, s)
+		n += x
+		if m.Event.OnReplicated != nil {
+			m.Event.OnReplicated(s, x, err)
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// followRange applies the feed of range start until the range is finished.
+func (m *Manager) followRange(ctx context.Context, addr string, start int64) (n int, err error) {
+	b := m.tailRange(start)
+	if b == nil {
+		if b, err = OpenFrom(m.store, m.getName(start)); err != nil {
+			return 0, err
+		}
+		if b == nil {
+			// New ranges are fetched, so they have the geometry of the primary.
+			if b, err = m.snapshot(ctx, addr, start); err != nil {
+				return 0, err
+			}
+			if err := m.saveReplicated(b, false); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	q := url.Values{"start": {strconv.FormatInt(start, 10)}}
+	q.Set("id", strconv.FormatInt(b.Len(), 10))
+	resp, err := m.get(ctx, addr, "/feed", q)
+	if err == errFeedGone {
+		if b, err = m.snapshot(ctx, addr, start); err != nil {
+			return 0, err
+		}
+		if err := m.saveReplicated(b, false); err != nil {
+			return 0, err
+		}
+		q.Set("id", strconv.FormatInt(b.Len(), 10))
+		resp, err = m.get(ctx, addr, "/feed", q)
+	}
+	m.setTail(b)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	rd := bufio.NewReader(resp.Body)
+	for {
+		buf, err := readRecord(rd)
+		if err == io.EOF {
+			return n, fmt.Errorf("feed of %d: unexpected EOF", start)
+		}
+		if err != nil {
+			return n, fmt.Errorf("feed of %d: %v", start, err)
+		}
+		if s := int64(binary.BigEndian.Uint64(buf)); s != start {
+			return n, fmt.Errorf("feed of %d: unexpected range %d", start, s)
+		}
+		if binary.BigEndian.Uint32(buf[16:]) == 0 {
+			// The range is finished.
+			return n, m.saveReplicated(b, true)
+		}
+		x, err := replayRecord(b, buf[8:], nil)
+		n += x
+		if err != nil {
+			return n, fmt.Errorf("feed of %d: %v", start, err)
+		}
+		if err := m.saveReplicated(b, false); err != nil {
+			return n, err
+		}
+	}
+}
+
+func (m *Manager) snapshot(ctx context.Context, addr string, start int64) (*Range, error) {
+	resp, err := m.get(ctx, addr, "/snapshot", url.Values{"start": {strconv.FormatInt(start, 10)}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := Unmarshal(bufio.NewReader(resp.Body))
+	if err != nil {
+		return nil, fmt.Errorf("snapshot of %d: %v", start, err)
+	}
+	return b, nil
+}
+
+func (m *Manager) saveReplicated(b *Range, compress bool) error {
+	if _, err := b.SaveIncrementalTo(m.store, m.getName(b.Start()), compress); err != nil {
+		return err
+	}
+	if last, ok := m.Last(); !ok || last < b.Start() {
+		return m.ReloadFiles()
+	}
+	return nil
+}
+
+func (m *Manager) get(ctx context.Context, addr, path string, q url.Values) (*http.Response, error) {
+	u := addr + path
+	if q != nil {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errFeedGone
+		}
+		return nil, errors.New(resp.Status + ": " + string(msg))
+	}
+	return resp, nil
+}
@@ -0,0 +1,159 @@
+package bitmap
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	m, err := NewStorageManager(NewMemStorage(), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	// Only the last batch is kept, followers joining later start from snapshots.
+	m.FeedSize = 1
+	srv := httptest.NewServer(m.ReplicationHandler())
+	defer srv.Close()
+
+	add := func(from, to int) { fillManager(t, m, from, to, nil) }
+	count := func(r *Manager) int {
+		res, _ := r.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+		return len(res)
+	}
+	wait := func(f *Manager) {
+		m.mu.Lock()
+		start, id := m.current.Range().Start(), m.current.Range().Len()
+		m.mu.Unlock()
+		for i := 0; i < 200; i++ {
+			if s, x := f.Position(); s == start && x == id {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		s, x := f.Position()
+		t.Fatal(s, x, start, id)
+	}
+
+	add(0, 10)
+	add(10, 15)
+
+	store := NewMemStorage()
+	f, err := NewFollowerManager(store, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(f)
+	if f.Saver() != nil {
+		t.Fatal("saver")
+	}
+	if n := count(f); n != 15 {
+		t.Fatal(n)
+	}
+
+	for i := 15; i < 40; i += 3 {
+		add(i, i+3)
+	}
+	wait(f)
+	if n := count(f); n != 42 {
+		t.Fatal(n)
+	}
+	f.Close()
+
+	// Resume from local ranges.
+	add(42, 45)
+	f, err = NewFollowerManager(store, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	wait(f)
+	if n := count(f); n != 45 {
+		t.Fatal(n)
+	}
+	if a, b := len(m.files()), len(f.files()); a != b {
+		t.Fatal(a, b)
+	}
+}
+
+func TestReplicationSaveFailed(t *testing.T) {
+	s := &failCreate{MemStorage: NewMemStorage()}
+	m, err := NewStorageManager(s, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	fillManager(t, m, 0, 3, nil)
+	s.fail = true
+	if err := m.Saver().SetCheckpointInterval(0).Add(Uint64Key(3), []uint64{1}); err == nil {
+		t.Fatal("saved")
+	}
+	m.feed.mu.Lock()
+	defer m.feed.mu.Unlock()
+	if n := len(m.feed.batches); n != 1 || m.feed.batches[0].end != 3 {
+		t.Fatal(m.feed.batches)
+	}
+}
+
+func TestReplicationDelete(t *testing.T) {
+	m, err := NewStorageManager(NewMemStorage(), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	srv := httptest.NewServer(m.ReplicationHandler())
+	defer srv.Close()
+	starts := fillManager(t, m, 0, 15, nil)
+
+	f, err := NewFollowerManager(NewMemStorage(), srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	wait := func(id int64) {
+		for i := 0; i < 200; i++ {
+			if s, x := f.Position(); s == starts[1] && x == id {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal(f.Position())
+	}
+	wait(5)
+	if found, err := m.Delete(Uint64Key(3)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+	fillManager(t, m, 15, 16, nil)
+	wait(6)
+
+	// Deletes are not replicated.
+	for mgr, n := range map[*Manager]int{m: 15, f: 16} {
+		res, _ := mgr.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+		if len(res) != n {
+			t.Fatal(len(res), n)
+		}
+	}
+}
+
+type failCreate struct {
+	*MemStorage
+	fail bool
+}
+
+func (s *failCreate) Create(name string) (io.WriteCloser, error) {
+	if s.fail {
+		return nil, fmt.Errorf("create %s: failed", name)
+	}
+	return s.MemStorage.Create(name)
+}
+
+func (s *failCreate) OpenFile(name string) (StorageFile, int64, error) {
+	if s.fail && !strings.HasSuffix(name, ".wal") {
+		return nil, 0, fmt.Errorf("open %s: failed", name)
+	}
+	return s.MemStorage.OpenFile(name)
+}
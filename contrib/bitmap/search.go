@@ -0,0 +1,67 @@
+package bitmap
+
+import (
+	"time"
+
+	"github.com/coyove/sdss/contrib/clock"
+)
+
+// ClockIdKeyTime extracts the unix milli timestamp (in seconds precision) from
+// keys created by Uint64Key(clock.Id()), can be used as Manager.KeyTime along with
+// KeyTimePrecision set to time.Second.
+func ClockIdKeyTime(k Key) int64 {
+	return clock.ParseIdUnix(k.LowUint64()) * 1000
+}
+
+// Search collects at most n hits added between 'from' and 'to' in descending order,
+// zero 'from' or 'to' means unbounded. Ranges are selected by their start times,
+// since range files are named by them. Entries of a range overlapping the bounds
+// are filtered by their timestamps (see Range.AddAt), or by KeyTime if they have
+// none. dedup can be nil.
+func (m *Manager) Search(vs Values, from, to time.Time, n int, dedup interface{ Add(Key) bool }) (res []KeyIdScore, jms []JoinMetrics) {
+	fromMs, toMs := int64(0), clock.UnixMilli()
+	if !from.IsZero() {
+		fromMs = from.UnixMilli()
+	}
+	if !to.IsZero() {
+		toMs = to.UnixMilli()
+	}
+	if n <= 0 || fromMs > toMs {
+		return
+	}
+
+	start := time.Now()
+	vs.Clean()
+	q := QueryTime(fromMs, toMs)
+	if vq := vs.Query(); vq != nil {
+		// Time has no scored terms, so indices of KeyIdScore.Terms are unchanged.
+		q = QueryAnd(vq, q)
+		q.Explain = vq.Explain
+	}
+
+	// A key time ts means the entry was added within [ts, ts+precision).
+	precision := m.KeyTimePrecision.Milliseconds()
+	if precision < 1 {
+		precision = 1
+	}
+	err := m.WalkDesc(toMs, func(b *Range) bool {
+		jm := b.JoinQuery(q, -1, true, func(kis KeyIdScore) bool {
+			if kis.Time == 0 && m.KeyTime != nil {
+				if ts := m.KeyTime(kis.Key); ts > 0 && (ts+precision-1 < fromMs || ts > toMs) {
+					return true
+				}
+			}
+			if dedup == nil || dedup.Add(kis.Key) {
+				res = append(res, kis)
+			}
+			return len(res) < n
+		})
+		jm.Values = vs
+		jms = append(jms, jm)
+		// Ranges before b only contain entries older than b.Start().
+		return len(res) < n && b.Start() > fromMs && jm.Err == nil
+	})
+	m.stats().observeJoins(jms)
+	m.traceSlow(start, jms, len(res), walkErr(err, jms))
+	return
+}
@@ -0,0 +1,244 @@
+package bitmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+)
+
+// Segments are appended after the indexed layout to persist changes since the
+// last full save:
+//
+//	size(4) checksum(4) firstId(8) count(4) entries fastLen(4) fast(fastLen*4)
+//	deadLen(4) dead(deadLen*8)
+//
+// And each entry is:
+//
+//	key(16) ts(8) xfLen(4) xf [valsLen(4) vals]
+//
+// firstId, ids in dead are relative to the start of the range. Stored values are
+// present if count has segValuesFlag set.
+const (
+	maxSegments   = 64
+	segValuesFlag = 1 << 31
+)
+
+type segState struct {
+	track bool
+	store Storage
+	name  string
+	base  int64 // size of the indexed layout
+	size  int64 // size of the whole file
+	end   int64
+	count int
+	fast  []uint32
+	dead  []int64
+}
+
+// loaded marks the range loaded from name in store, only ranges in indexed layout
+// can be saved incrementally.
+func (s *segState) loaded(store Storage, name string) {
+	if s.base > 0 {
+		s.track, s.store, s.name = true, store, name
+	}
+}
+
+func (s *segState) trackFast(v uint32) {
+	if s.track {
+		s.fast = append(s.fast, v)
+	}
+}
+
+func (s *segState) trackDead(ids ...int64) {
+	if s.track {
+		s.dead = append(s.dead, ids...)
+	}
+}
+
+// SaveIncremental appends changes since the last save to path as a segment, see
+// SaveIncrementalTo.
+func (b *Range) SaveIncremental(path string, compress bool) (int, error) {
+	return b.SaveIncrementalTo(Dir(filepath.Dir(path)), filepath.Base(path), compress)
+}
+
+// SaveIncrementalTo appends changes since the last save to name in s as a segment.
+// The range will be fully saved instead if it was not loaded from or saved to the
+// same place before, the file was changed by others (e.g.: torn segments), there
+// are too many segments, or s is not a FileStorage. Saved bytes are never rewritten,
+// since the file may be memory mapped, full saves replace the file by renaming.
+func (b *Range) SaveIncrementalTo(s Storage, name string, compress bool) (int, error) {
+	b.mfmu.Lock()
+	defer b.mfmu.Unlock()
+
+	b.mu.RLock()
+	b.segmu.Lock()
+	from, end, size, withValues := b.seg.end, b.end, b.seg.size, b.storeValues
+	fast, dead := b.seg.fast, b.seg.dead
+	full := b.seg.store != s || b.seg.name != name || b.seg.count >= maxSegments || b.seg.size-b.seg.base > b.seg.base
+	b.segmu.Unlock()
+	b.mu.RUnlock()
+
+	fs, ok := s.(FileStorage)
+	if full || !ok {
+		return b.save(s, name, compress)
+	}
+	if end == from && len(fast) == 0 && len(dead) == 0 {
+		return 0, nil
+	}
+
+	f, fsize, err := fs.OpenFile(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if fsize != size {
+		// The file was replaced, or has torn segments which can't be truncated.
+		return b.save(s, name, compress)
+	}
+
+	seg, err := b.encodeSegment(from+1, end, fast, dead, withValues)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt(seg, size); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+
+	b.segmu.Lock()
+	b.seg.end = end
+	b.seg.size += int64(len(seg))
+	b.seg.count++
+	b.seg.fast = append([]uint32{}, b.seg.fast[len(fast):]...)
+	b.seg.dead = append([]int64{}, b.seg.dead[len(dead):]...)
+	b.segmu.Unlock()
+	return len(seg), nil
+}
+
+func (b *Range) encodeSegment(from, to int64, fast []uint32, dead []int64, withValues bool) ([]byte, error) {
+	p := &bytes.Buffer{}
+	p.Write(make([]byte, 8))
+	binary.Write(p, binary.BigEndian, from)
+	count := uint32(to - from + 1)
+	if withValues {
+		count |= segValuesFlag
+	}
+	binary.Write(p, binary.BigEndian, count)
+	for id := from; id <= to; id++ {
+		m := b.slots[id/b.slotSize]
+		if err := m.ensure(); err != nil {
+			return nil, err
+		}
+		i := id % b.slotSize
+		m.mu.RLock()
+		xf := m.xfs[m.prevSpan(i):m.spans[i]]
+		p.Write(m.keys[i][:])
+		binary.Write(p, binary.BigEndian, m.timestamp(i))
+		binary.Write(p, binary.BigEndian, uint32(len(xf)))
+		p.Write(xf)
+		if withValues {
+			vals := m.rawValues(i)
+			binary.Write(p, binary.BigEndian, uint32(len(vals)))
+			p.Write(vals)
+		}
+		m.mu.RUnlock()
+	}
+	binary.Write(p, binary.BigEndian, uint32(len(fast)))
+	binary.Write(p, binary.BigEndian, fast)
+	binary.Write(p, binary.BigEndian, uint32(len(dead)))
+	binary.Write(p, binary.BigEndian, dead)
+
+	buf := p.Bytes()
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-8))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[8:]))
+	return buf, nil
+}
+
+// applySegments applies segments in buf to b, returns the size of valid segments.
+// A torn segment at the end is ignored.
+func (b *Range) applySegments(buf []byte) (n int, count int, err error) {
+	for len(buf)-n >= 8 {
+		size := int(binary.BigEndian.Uint32(buf[n:]))
+		if size > len(buf)-n-8 {
+			break
+		}
+		seg := buf[n+8 : n+8+size]
+		if crc32.ChecksumIEEE(seg) != binary.BigEndian.Uint32(buf[n+4:]) {
+			break
+		}
+		if err := b.applySegment(seg); err != nil {
+			return n, count, fmt.Errorf("read segment at %d: %v", n, err)
+		}
+		n += 8 + size
+		count++
+	}
+	return n, count, nil
+}
+
+func (b *Range) applySegment(buf []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid segment: %v", r)
+		}
+	}()
+
+	from := int64(binary.BigEndian.Uint64(buf))
+	if from != b.end+1 {
+		return fmt.Errorf("expect entries from %d, got %d", b.end+1, from)
+	}
+	count := binary.BigEndian.Uint32(buf[8:])
+	withValues := count&segValuesFlag != 0
+	count &^= segValuesFlag
+	if withValues {
+		b.storeValues = true
+	}
+	buf = buf[12:]
+	for i := 0; i < int(count); i++ {
+		key := BytesKey(buf[:KeySize])
+		ts := int64(binary.BigEndian.Uint64(buf[KeySize:]))
+		xf := buf[KeySize+12 : KeySize+12+int(binary.BigEndian.Uint32(buf[KeySize+8:]))]
+		buf = buf[KeySize+12+len(xf):]
+		var vals []byte
+		if withValues {
+			vals = buf[4 : 4+int(binary.BigEndian.Uint32(buf))]
+			buf = buf[4+len(vals):]
+		}
+
+		if b.end == b.Capacity()-1 {
+			return ErrBitmapFull
+		}
+		b.end++
+		m := b.slots[b.end/b.slotSize]
+		if err := m.ensure(); err != nil {
+			return err
+		}
+		m.append(key, xf, vals, ts)
+	}
+
+	fast := make([]uint32, binary.BigEndian.Uint32(buf))
+	buf = buf[4:]
+	for i := range fast {
+		fast[i] = binary.BigEndian.Uint32(buf[i*4:])
+	}
+	buf = buf[len(fast)*4:]
+	b.fastTable.AddMany(fast)
+
+	dead := make([]int64, binary.BigEndian.Uint32(buf))
+	buf = buf[4:]
+	for i := range dead {
+		dead[i] = int64(binary.BigEndian.Uint64(buf[i*8:]))
+		if dead[i] < 0 || dead[i] > b.end {
+			return fmt.Errorf("invalid tombstone %d", dead[i])
+		}
+		m := b.slots[dead[i]/b.slotSize]
+		if err := m.ensure(); err != nil {
+			return err
+		}
+		m.markDead(dead[i] % b.slotSize)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package bitmap
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ShardedManager distributes keys across managers by their hashes, so adds are
+// handled by multiple savers in parallel, queries are executed on all shards in
+// parallel and merged.
+type ShardedManager struct {
+	shards []*Manager
+}
+
+// NewShardedManager creates a manager for each dir, cache (can be nil) is shared by
+// all shards. Keys are assigned to shards by the positions of dirs, so the order
+// must not change across restarts.
+func NewShardedManager(dirs []string, switchLimit int64, cache *Cache) (*ShardedManager, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no shards")
+	}
+	if cache == nil {
+		cache = NewLRUCache(0)
+	}
+	s := &ShardedManager{}
+	for _, dir := range dirs {
+		m, err := NewManager(dir, switchLimit, cache)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, m)
+	}
+	return s, nil
+}
+
+// NewShardedManagerFrom creates a sharded manager from existing managers.
+func NewShardedManagerFrom(shards ...*Manager) *ShardedManager {
+	return &ShardedManager{shards: shards}
+}
+
+func (s *ShardedManager) Shards() []*Manager {
+	return s.shards
+}
+
+func (s *ShardedManager) Shard(key Key) *Manager {
+	h := fnv.New32a()
+	h.Write(key[:])
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *ShardedManager) Saver(key Key) *SaveAggregator {
+	return s.Shard(key).Saver()
+}
+
+func (s *ShardedManager) Add(key Key, values []uint64) error {
+	return s.Saver(key).Add(key, values)
+}
+
+func (s *ShardedManager) AddAt(key Key, values []uint64, ts int64) error {
+	return s.Saver(key).AddAt(key, values, ts)
+}
+
+func (s *ShardedManager) Delete(key Key) (bool, error) {
+	return s.Shard(key).Delete(key)
+}
+
+func (s *ShardedManager) Close() {
+	for _, m := range s.shards {
+		m.Close()
+	}
+}
+
+func (s *ShardedManager) String() string {
+	var p []byte
+	for i, m := range s.shards {
+		p = append(p, fmt.Sprintf("#%d %v\n", i, m)...)
+	}
+	return string(p)
+}
+
+// gather calls f on all shards in parallel, and concatenates the results and metrics.
+// Values must be cleaned before, so shards can share them.
+func (s *ShardedManager) gather(f func(*Manager) ([]KeyIdScore, []JoinMetrics)) (res []KeyIdScore, jms []JoinMetrics) {
+	results := make([][]KeyIdScore, len(s.shards))
+	metrics := make([][]JoinMetrics, len(s.shards))
+	var wg sync.WaitGroup
+	wg.Add(len(s.shards))
+	for i, m := range s.shards {
+		go func(i int, m *Manager) {
+			defer wg.Done()
+			results[i], metrics[i] = f(m)
+		}(i, m)
+	}
+	wg.Wait()
+	for i := range s.shards {
+		res = append(res, results[i]...)
+		jms = append(jms, metrics[i]...)
+	}
+	return
+}
+
+type lockedDedup struct {
+	mu sync.Mutex
+	d  interface{ Add(Key) bool }
+}
+
+func (d *lockedDedup) Add(k Key) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.d.Add(k)
+}
+
+// sortNewest sorts res from the newest to the oldest and keeps the first n. Ids of
+// different shards are not comparable, so entries are ordered by their timestamps
+// (see timeOf), then by starts of their ranges and offsets, see KeyIdScore.before.
+func (s *ShardedManager) sortNewest(res []KeyIdScore, n int) []KeyIdScore {
+	type hit struct {
+		ts int64
+		KeyIdScore
+	}
+	hits := make([]hit, len(res))
+	for i, k := range res {
+		hits[i] = hit{s.timeOf(k), k}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].ts != hits[j].ts {
+			return hits[i].ts > hits[j].ts
+		}
+		return hits[j].before(hits[i].KeyIdScore)
+	})
+	if len(hits) > n {
+		hits = hits[:n]
+	}
+	res = res[:len(hits)]
+	for i := range hits {
+		res[i] = hits[i].KeyIdScore
+	}
+	return res
+}
+
+// timeOf returns the unix milli timestamp of k: Time, KeyTime of its shard, or the
+// start of its range if both are unknown.
+func (s *ShardedManager) timeOf(k KeyIdScore) int64 {
+	if k.Time > 0 {
+		return k.Time
+	}
+	if f := s.Shard(k.Key).KeyTime; f != nil {
+		if ts := f(k.Key); ts > 0 {
+			return ts
+		}
+	}
+	return k.Start
+}
+
+// CollectSimple collects n hits from each shard and returns the newest n, see sortNewest.
+// dedup is shared by all shards and may see keys which are not returned.
+func (s *ShardedManager) CollectSimple(dedup interface{ Add(Key) bool }, vs Values, n int) (res []KeyIdScore, jms []JoinMetrics) {
+	vs.Clean()
+	d := &lockedDedup{d: dedup}
+	res, jms = s.gather(func(m *Manager) ([]KeyIdScore, []JoinMetrics) {
+		return m.CollectSimple(d, vs, n)
+	})
+	return s.sortNewest(res, n), jms
+}
+
+// Search is the sharded version of Manager.Search, see CollectSimple.
+func (s *ShardedManager) Search(vs Values, from, to time.Time, n int, dedup interface{ Add(Key) bool }) (res []KeyIdScore, jms []JoinMetrics) {
+	vs.Clean()
+	var d interface{ Add(Key) bool }
+	if dedup != nil {
+		d = &lockedDedup{d: dedup}
+	}
+	res, jms = s.gather(func(m *Manager) ([]KeyIdScore, []JoinMetrics) {
+		return m.Search(vs, from, to, n, d)
+	})
+	return s.sortNewest(res, n), jms
+}
+
+// CollectTopK collects top k hits from each shard and returns the best k by their scores.
+func (s *ShardedManager) CollectTopK(vs Values, k int, timeBudget time.Duration) (res []KeyIdScore, jms []JoinMetrics) {
+	vs.Clean()
+	res, jms = s.gather(func(m *Manager) ([]KeyIdScore, []JoinMetrics) {
+		return m.CollectTopK(vs, k, timeBudget)
+	})
+	h := kisHeap(res)
+	sort.Slice(res, func(i, j int) bool { return h.Less(j, i) })
+	if len(res) > k {
+		res = res[:k]
+	}
+	return
+}
@@ -0,0 +1,123 @@
+package bitmap
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/coyove/sdss/contrib/clock"
+)
+
+func TestShardedManager(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewShardedManager([]string{
+		filepath.Join(dir, "0"), filepath.Join(dir, "1"), filepath.Join(dir, "2"),
+	}, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var outs []chan error
+	for i := 0; i < 60; i++ {
+		k := Uint64Key(uint64(i))
+		outs = append(outs, s.Saver(k).AddAsync(k, []uint64{1, uint64(i%3 + 10)}))
+	}
+	for _, out := range outs {
+		if err := <-out; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range s.Shards() {
+		if n := m.Saver().Range().Len(); n == 0 || n == 60 {
+			t.Fatal("unbalanced", n)
+		}
+	}
+
+	res, jms := s.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+	if len(res) != 60 || len(jms) != 3 {
+		t.Fatal(len(res), len(jms))
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i-1].before(res[i]) {
+			t.Fatal(res)
+		}
+	}
+	if res, _ := s.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 5); len(res) != 5 {
+		t.Fatal(res)
+	}
+
+	res, _ = s.CollectTopK(Values{Major: []uint64{10, 11}, Weights: map[uint64]float64{11: 2}, MinScore: 1}, 10, 0)
+	if len(res) != 10 {
+		t.Fatal(res)
+	}
+	for _, r := range res {
+		if r.Score != 2 || r.Key.LowUint64()%3 != 1 {
+			t.Fatal(r)
+		}
+	}
+
+	if found, err := s.Delete(Uint64Key(4)); !found || err != nil {
+		t.Fatal(found, err)
+	}
+	if res, _ := s.CollectSimple(distinct{}, Values{Exact: []uint64{11}}, 100); len(res) != 19 {
+		t.Fatal(len(res))
+	}
+}
+
+func TestShardedOrder(t *testing.T) {
+	dir := t.TempDir()
+	m0, err := NewManager(filepath.Join(dir, "0"), 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m0.Close()
+	fillManager(t, m0, 0, 20, nil)
+
+	// Ids of the newer shard are smaller than ids of older entries in m0.
+	for start := m0.Saver().Range().Start(); clock.UnixMilli() <= start; {
+	}
+	m1, err := NewManager(filepath.Join(dir, "1"), 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m1.Close()
+	fillManager(t, m1, 20, 21, nil)
+
+	res, _ := NewShardedManagerFrom(m0, m1).CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 2)
+	if len(res) != 2 || res[0].Key != Uint64Key(20) || res[1].Key != Uint64Key(19) {
+		t.Fatal(res)
+	}
+}
+
+func TestShardedOrderTime(t *testing.T) {
+	dir := t.TempDir()
+	m0, err := NewManager(filepath.Join(dir, "0"), 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m0.Close()
+	for start := m0.Saver().Range().Start(); clock.UnixMilli() <= start; {
+	}
+	m1, err := NewManager(filepath.Join(dir, "1"), 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m1.Close()
+
+	// The newest hit is in the older range of m0.
+	now := clock.UnixMilli()
+	if err := m1.Saver().AddAt(Uint64Key(1), []uint64{1}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := m0.Saver().AddAt(Uint64Key(2), []uint64{1}, now+20); err != nil {
+		t.Fatal(err)
+	}
+	if m0.Saver().Range().Start() >= m1.Saver().Range().Start() {
+		t.Fatal("starts")
+	}
+
+	res, _ := NewShardedManagerFrom(m0, m1).CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 2)
+	if len(res) != 2 || res[0].Key != Uint64Key(2) || res[1].Key != Uint64Key(1) {
+		t.Fatal(res)
+	}
+}
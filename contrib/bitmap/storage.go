@@ -0,0 +1,267 @@
+package bitmap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage stores range files and WALs by names. Implementations must be comparable,
+// e.g.: pointers, because ranges remember where they were saved.
+type Storage interface {
+	// List returns names of all files.
+	List() ([]string, error)
+	// Open opens name for reading, the returned error satisfies
+	// errors.Is(err, os.ErrNotExist) if name doesn't exist.
+	Open(name string) (StorageReader, error)
+	// Create creates or truncates name for writing, the content should become
+	// visible as a whole after closing.
+	Create(name string) (io.WriteCloser, error)
+	// Rename renames from to to, replacing to if it exists.
+	Rename(from, to string) error
+	Remove(name string) error
+}
+
+type StorageReader interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// StorageFile is a file supporting random access, *os.File implements it.
+type StorageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// FileStorage is implemented by storages supporting random access files, which
+// are required by SaveIncremental and WAL. Otherwise ranges are fully saved on
+// every checkpoint.
+type FileStorage interface {
+	Storage
+	// OpenFile opens name for reading and writing, it will be created if not existed.
+	OpenFile(name string) (StorageFile, int64, error)
+}
+
+// Dir stores files in a local directory, files will be memory mapped when opened.
+type Dir string
+
+func (d Dir) List() ([]string, error) {
+	df, err := os.Open(string(d))
+	if err != nil {
+		return nil, err
+	}
+	defer df.Close()
+	return df.Readdirnames(-1)
+}
+
+func (d Dir) Open(name string) (StorageReader, error) {
+	f, err := os.Open(filepath.Join(string(d), name))
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dirReader{File: f, size: st.Size(), modTime: st.ModTime()}, nil
+}
+
+func (d Dir) Create(name string) (io.WriteCloser, error) {
+	return os.Create(filepath.Join(string(d), name))
+}
+
+func (d Dir) Rename(from, to string) error {
+	return os.Rename(filepath.Join(string(d), from), filepath.Join(string(d), to))
+}
+
+func (d Dir) Remove(name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
+
+func (d Dir) OpenFile(name string) (StorageFile, int64, error) {
+	f, err := os.OpenFile(filepath.Join(string(d), name), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, st.Size(), nil
+}
+
+type dirReader struct {
+	*os.File
+	size    int64
+	modTime time.Time
+}
+
+func (r *dirReader) Size() int64 {
+	return r.size
+}
+
+func (r *dirReader) ModTime() time.Time {
+	return r.modTime
+}
+
+func (r *dirReader) mmap() (*mmapFile, error) {
+	return mmapOpen(r.File)
+}
+
+// MemStorage stores files in memory, it is mainly used for testing.
+type MemStorage struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{files: map[string]*memFile{}}
+}
+
+func (s *MemStorage) List() (names []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n := range s.files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemStorage) Open(name string) (StorageReader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &memReader{bytes.NewReader(f.data)}, nil
+}
+
+func (s *MemStorage) Create(name string) (io.WriteCloser, error) {
+	return &memWriter{s: s, name: name}, nil
+}
+
+func (s *MemStorage) Rename(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[from]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrNotExist}
+	}
+	delete(s.files, from)
+	s.files[to] = f
+	return nil
+}
+
+func (s *MemStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *MemStorage) OpenFile(name string) (StorageFile, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		f = &memFile{}
+		s.files[name] = f
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f, int64(len(f.data)), nil
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (r *memReader) Close() error {
+	return nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	s    *MemStorage
+	name string
+}
+
+func (w *memWriter) Close() error {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	w.s.files[w.name] = &memFile{data: w.Bytes()}
+	return nil
+}
+
+// memFile never shrinks or modifies data in place, so readers opened before
+// are not affected.
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	data := make([]byte, len(f.data), len(f.data)+len(p))
+	copy(data, f.data)
+	if end := off + int64(len(p)); end > int64(len(data)) {
+		data = append(data, make([]byte, end-int64(len(data)))...)
+	}
+	copy(data[off:], p)
+	f.data = data
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size:size]
+	} else {
+		f.data = append(f.data[:len(f.data):len(f.data)], make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
@@ -0,0 +1,187 @@
+package bitmap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ObjectClient is the subset of object store (e.g.: S3) APIs used by ObjectStorage.
+// Methods should return errors satisfying errors.Is(err, os.ErrNotExist) for
+// missing objects.
+type ObjectClient interface {
+	// ListObjects returns keys of all objects starting with prefix.
+	ListObjects(prefix string) ([]string, error)
+	HeadObject(key string) (size int64, err error)
+	GetObjectRange(key string, offset, length int64) ([]byte, error)
+	PutObject(key string, data []byte) error
+	CopyObject(src, dst string) error
+	DeleteObject(key string) error
+}
+
+// ObjectStorage stores files as objects under Prefix. Files are uploaded as a
+// whole and read by ranges, random writes are not supported, so ranges will
+// be fully saved on every checkpoint and there will be no WAL.
+type ObjectStorage struct {
+	Client ObjectClient
+	Prefix string
+}
+
+func NewObjectStorage(client ObjectClient, prefix string) *ObjectStorage {
+	return &ObjectStorage{Client: client, Prefix: prefix}
+}
+
+func (s *ObjectStorage) List() ([]string, error) {
+	keys, err := s.Client.ListObjects(s.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if n := strings.TrimPrefix(k, s.Prefix); n != "" && !strings.Contains(n, "/") {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
+
+func (s *ObjectStorage) Open(name string) (StorageReader, error) {
+	size, err := s.Client.HeadObject(s.Prefix + name)
+	if err != nil {
+		return nil, err
+	}
+	return &objectReader{s: s, key: s.Prefix + name, size: size}, nil
+}
+
+func (s *ObjectStorage) Create(name string) (io.WriteCloser, error) {
+	return &objectWriter{s: s, key: s.Prefix + name}, nil
+}
+
+func (s *ObjectStorage) Rename(from, to string) error {
+	if err := s.Client.CopyObject(s.Prefix+from, s.Prefix+to); err != nil {
+		return err
+	}
+	return s.Client.DeleteObject(s.Prefix + from)
+}
+
+func (s *ObjectStorage) Remove(name string) error {
+	return s.Client.DeleteObject(s.Prefix + name)
+}
+
+type objectReader struct {
+	s    *ObjectStorage
+	key  string
+	size int64
+}
+
+func (r *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if off+n > r.size {
+		n = r.size - off
+	}
+	data, err := r.s.Client.GetObjectRange(r.key, off, n)
+	if err != nil {
+		return 0, err
+	}
+	if copy(p, data) < len(p) {
+		return len(data), io.EOF
+	}
+	return len(p), nil
+}
+
+func (r *objectReader) Size() int64 {
+	return r.size
+}
+
+func (r *objectReader) Close() error {
+	return nil
+}
+
+type objectWriter struct {
+	bytes.Buffer
+	s   *ObjectStorage
+	key string
+}
+
+func (w *objectWriter) Close() error {
+	return w.s.Client.PutObject(w.key, w.Bytes())
+}
+
+// LocalObjectClient is an ObjectClient storing objects as files in a local
+// directory, it can be used as a stand-in of the real object store.
+type LocalObjectClient string
+
+func (c LocalObjectClient) path(key string) string {
+	return filepath.Join(string(c), filepath.FromSlash(key))
+}
+
+func (c LocalObjectClient) ListObjects(prefix string) (keys []string, err error) {
+	err = filepath.Walk(string(c), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".objtmp") {
+			return err
+		}
+		rel, err := filepath.Rel(string(c), path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (c LocalObjectClient) HeadObject(key string) (int64, error) {
+	st, err := os.Stat(c.path(key))
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func (c LocalObjectClient) GetObjectRange(key string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+func (c LocalObjectClient) PutObject(key string, data []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%p.objtmp", path, &data)
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (c LocalObjectClient) CopyObject(src, dst string) error {
+	data, err := os.ReadFile(c.path(src))
+	if err != nil {
+		return err
+	}
+	return c.PutObject(dst, data)
+}
+
+func (c LocalObjectClient) DeleteObject(key string) error {
+	return os.Remove(c.path(key))
+}
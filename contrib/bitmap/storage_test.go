@@ -0,0 +1,126 @@
+package bitmap
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/coyove/sdss/contrib/clock"
+)
+
+func TestStorage(t *testing.T) {
+	for _, s := range []Storage{
+		NewMemStorage(),
+		NewObjectStorage(LocalObjectClient(t.TempDir()), "ranges/"),
+	} {
+		m, err := NewStorageManager(s, 10, NewLRUCache(1e6))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillManager(t, m, 0, 25, func(i int) []uint64 { return []uint64{uint64(i % 2)} })
+
+		names, _ := s.List()
+		_, isFile := s.(FileStorage)
+		for _, n := range names {
+			if strings.HasSuffix(n, ".wal") && !isFile {
+				t.Fatal(names)
+			}
+		}
+
+		// Reopen without closing.
+		m2, err := NewStorageManager(s, 10, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m2.dirFiles) != 3 || m2.Saver().Range().Len() != 5 {
+			t.Fatal(m2.dirFiles, m2.Saver().Range().Len())
+		}
+		res, _ := m2.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+		if len(res) != 12 || res[0].Key != Uint64Key(23) {
+			t.Fatal(res)
+		}
+		m.Close()
+		m2.Close()
+	}
+}
+
+func TestWALFailed(t *testing.T) {
+	s := &noWAL{Dir: Dir(t.TempDir())}
+	m, err := NewStorageManager(s, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var failed []int64
+	m.Event.OnWALFailed = func(start int64, err error) { failed = append(failed, start) }
+	s.fail = true
+	starts := fillManager(t, m, 0, 25, nil)
+	if len(failed) != 2 || failed[0] != starts[1] || failed[1] != starts[2] {
+		t.Fatal(failed, starts)
+	}
+	res, _ := m.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+	if len(res) != 25 {
+		t.Fatal(len(res))
+	}
+}
+
+type noWAL struct {
+	Dir
+	fail bool
+}
+
+func (s *noWAL) OpenFile(name string) (StorageFile, int64, error) {
+	if s.fail && strings.HasSuffix(name, ".wal") {
+		return nil, 0, fmt.Errorf("open %s: failed", name)
+	}
+	return s.Dir.OpenFile(name)
+}
+
+type distinct struct{}
+
+func (distinct) Add(Key) bool { return true }
+
+func TestManagerRangeStarts(t *testing.T) {
+	m, err := NewStorageManager(NewMemStorage(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	// The current range starts later than now, e.g.: filled within a millisecond.
+	sa := m.Saver()
+	sa.Range().start = clock.UnixMilli() + 300
+	if err := sa.Add(Uint64Key(1), []uint64{1}); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.Saver().Range().Start(); s <= sa.Range().Start() {
+		t.Fatal(s, sa.Range().Start())
+	}
+}
+
+// fillManager adds keys [from, to) asynchronously, batches are cut at the switch
+// limit of m, so full ranges are switched by the next Saver. It returns starts of
+// ranges written, values default to [1].
+func fillManager(t *testing.T, m *Manager, from, to int, values func(int) []uint64) (starts []int64) {
+	for from < to {
+		sa := m.Saver()
+		end := from + int(m.switchLimit-sa.Range().Len())
+		if end <= from || end > to {
+			end = to
+		}
+		var outs []chan error
+		for i := from; i < end; i++ {
+			vs := []uint64{1}
+			if values != nil {
+				vs = values(i)
+			}
+			outs = append(outs, sa.AddAsync(Uint64Key(uint64(i)), vs))
+		}
+		for _, out := range outs {
+			if err := <-out; err != nil {
+				t.Fatal(err)
+			}
+		}
+		starts, from = append(starts, sa.Range().Start()), end
+	}
+	return starts
+}
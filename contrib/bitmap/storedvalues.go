@@ -0,0 +1,108 @@
+package bitmap
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// EnableStoredValues makes the range keep the original values of entries added
+// afterward, so they can be returned by Values and FindValues, and hits of joins
+// in explain mode carry matched terms in KeyIdScore.Matched. Values are sorted and delta encoded
+// as varints, which costs about 2-9 bytes per value. The mode is persisted.
+func (b *Range) EnableStoredValues() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.storeValues = true
+}
+
+func (b *Range) StoredValues() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.storeValues
+}
+
+// Values returns stored values of the entry at id, nil if not stored.
+func (b *Range) Values(id int64) []uint64 {
+	b.mu.RLock()
+	offset := id - b.start
+	if offset < 0 || offset > b.end {
+		b.mu.RUnlock()
+		return nil
+	}
+	m := b.slots[offset/b.slotSize]
+	b.mu.RUnlock()
+
+	if m.ensure() != nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return decodeValues(m.rawValues(offset % b.slotSize))
+}
+
+// FindValues is Find but returns stored values of the entry, nil if not found or
+// not stored.
+func (b *Range) FindValues(key Key) (int64, []uint64) {
+	off, ok := b.findOffset(key)
+	if !ok {
+		return 0, nil
+	}
+	return off, b.Values(b.start + off)
+}
+
+func (m *subMap) rawValues(i int64) []byte {
+	if m.valSpans == nil {
+		return nil
+	}
+	var start uint32
+	if i > 0 {
+		start = m.valSpans[i-1]
+	}
+	return m.vals[start:m.valSpans[i]]
+}
+
+// matchedValues returns terms found in sorted values vs, nil if vs is nil.
+func matchedValues(vs, terms []uint64) (res []uint64) {
+	if vs == nil {
+		return nil
+	}
+	res = []uint64{}
+	for _, t := range terms {
+		if containsValue(vs, t) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+func containsValue(vs []uint64, v uint64) bool {
+	i := sort.Search(len(vs), func(i int) bool { return vs[i] >= v })
+	return i < len(vs) && vs[i] == v
+}
+
+func encodeValues(values []uint64) []byte {
+	vs := append([]uint64{}, values...)
+	sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+	buf := make([]byte, 0, len(vs)*4)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	prev := uint64(0)
+	for _, v := range vs {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, v-prev)]...)
+		prev = v
+	}
+	return buf
+}
+
+func decodeValues(buf []byte) (vs []uint64) {
+	prev := uint64(0)
+	for len(buf) > 0 {
+		d, w := binary.Uvarint(buf)
+		if w <= 0 {
+			break
+		}
+		buf = buf[w:]
+		prev += d
+		vs = append(vs, prev)
+	}
+	return vs
+}
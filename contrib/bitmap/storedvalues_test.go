@@ -0,0 +1,122 @@
+package bitmap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/coyove/sdss/contrib/simple"
+)
+
+func TestStoredValues(t *testing.T) {
+	path := t.TempDir() + "/r"
+	b := New(0)
+	b.Add(Uint64Key(0), []uint64{1, 2})
+	b.EnableStoredValues()
+	for i := 1; i < 100; i++ {
+		b.Add(Uint64Key(uint64(i)), []uint64{uint64(i), 1 << 40, 1})
+	}
+
+	check := func(b *Range, n int64) {
+		if !b.StoredValues() || b.Len() != n {
+			t.Fatal(b.Len())
+		}
+		if vs := b.Values(0); vs != nil {
+			t.Fatal(vs)
+		}
+		if vs := b.Values(50); !simple.Uint64.Equal(vs, []uint64{1, 50, 1 << 40}) {
+			t.Fatal(vs)
+		}
+		if off, vs := b.FindValues(Uint64Key(uint64(n - 1))); off != n-1 || len(vs) != 3 || vs[1] != uint64(n-1) {
+			t.Fatal(off, vs)
+		}
+		var res []KeyIdScore
+		b.Join(Values{Oneof: []uint64{1, 2, 30}, Explain: true}, -1, true, func(kis KeyIdScore) bool {
+			res = append(res, kis)
+			return true
+		})
+		if len(res) != int(n) {
+			t.Fatal(len(res))
+		}
+		for _, kis := range res {
+			switch kis.Id {
+			case 0:
+				if kis.Matched != nil {
+					t.Fatal(kis)
+				}
+			case 2, 30:
+				if !simple.Uint64.Equal(kis.Matched, []uint64{1, kis.Key.LowUint64()}) {
+					t.Fatal(kis)
+				}
+			default:
+				if !simple.Uint64.Equal(kis.Matched, []uint64{1}) {
+					t.Fatal(kis)
+				}
+			}
+		}
+	}
+	check(b, 100)
+	check(b.Clone(), 100)
+
+	for _, compress := range []bool{false, true} {
+		b2, err := Unmarshal(bytes.NewReader(b.MarshalBinary(compress)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(b2, 100)
+	}
+
+	if _, err := b.Save(path, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 120; i++ {
+		b.Add(Uint64Key(uint64(i)), []uint64{uint64(i), 1 << 40, 1})
+	}
+	if n, err := b.SaveIncremental(path, false); err != nil || n <= 0 {
+		t.Fatal(n, err)
+	}
+	b2, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b2, 120)
+
+	b2.DeleteById(5)
+	b3, _ := b2.Compact(nil)
+	if vs := b3.Values(5); !simple.Uint64.Equal(vs, []uint64{1, 6, 1 << 40}) {
+		t.Fatal(vs)
+	}
+
+	// Matched values are only computed in explain mode.
+	b.Join(Values{Oneof: []uint64{1}}, -1, true, func(kis KeyIdScore) bool {
+		if kis.Matched != nil || kis.Terms != nil {
+			t.Fatal(kis)
+		}
+		return true
+	})
+
+	// Values are not stored by default.
+	b = New(0)
+	b.Add(Uint64Key(1), []uint64{1})
+	if _, vs := b.FindValues(Uint64Key(1)); b.StoredValues() || vs != nil {
+		t.Fatal(vs)
+	}
+}
+
+func TestManagerStoredValues(t *testing.T) {
+	m, err := NewStorageManager(NewMemStorage(), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.StoredValues = true
+	starts := fillManager(t, m, 0, 20, func(i int) []uint64 { return []uint64{1, uint64(i)} })
+	for i, s := range starts {
+		b, err := m.load(s)
+		if err != nil || !b.StoredValues() {
+			t.Fatal(s, err)
+		}
+		if vs := b.Values(s + 3); !simple.Uint64.Equal(vs, []uint64{1, uint64(i*10 + 3)}) {
+			t.Fatal(vs)
+		}
+	}
+}
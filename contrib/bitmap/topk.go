@@ -0,0 +1,102 @@
+package bitmap
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/coyove/sdss/contrib/clock"
+)
+
+type kisHeap []KeyIdScore
+
+func (h kisHeap) Len() int { return len(h) }
+
+func (h kisHeap) Less(i, j int) bool {
+	if h[i].Score == h[j].Score {
+		return h[i].before(h[j])
+	}
+	return h[i].Score < h[j].Score
+}
+
+func (h kisHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *kisHeap) Push(x interface{}) { *h = append(*h, x.(KeyIdScore)) }
+
+func (h *kisHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (m *Manager) recency(start, now int64) float64 {
+	if m.RecencyHalfLife <= 0 || start >= now {
+		return 1
+	}
+	return math.Pow(0.5, float64(now-start)/float64(m.RecencyHalfLife.Milliseconds()))
+}
+
+// CollectTopK walks ranges from the newest and returns the best k hits sorted by
+// their scores in descending order. Scores are decayed by the age of the range
+// they belong to (see RecencyHalfLife), so the walk stops once no remaining range
+// can beat the current k-th hit. Partial results will be returned if timeBudget
+// (if > 0) is exceeded. If a key appears in multiple ranges, only the newest one counts.
+func (m *Manager) CollectTopK(vs Values, k int, timeBudget time.Duration) (res []KeyIdScore, jms []JoinMetrics) {
+	if k <= 0 {
+		return
+	}
+
+	vs.Clean()
+	q := vs.Query()
+	maxScore := q.maxScore()
+	start, now := time.Now(), clock.UnixMilli()
+	seen := map[Key]bool{}
+	h := &kisHeap{}
+
+	full := func(bound float64) bool {
+		return h.Len() >= k && (*h)[0].Score >= bound
+	}
+
+	err := m.WalkDesc(now, func(b *Range) bool {
+		decay := m.recency(b.Start(), now)
+		if full(maxScore * decay) {
+			return false
+		}
+		fastStart := time.Now()
+		fast, bound := b.joinFastBound(q)
+		if full(bound * decay) {
+			return true
+		}
+
+		jm := JoinMetrics{FastElapsed: time.Since(fastStart)}
+		jm = b.joinQuery(context.Background(), q, fast, fastStart, -1, true, jm, func(kis KeyIdScore) bool {
+			if timeBudget > 0 && time.Since(start) > timeBudget {
+				return false
+			}
+			if seen[kis.Key] {
+				return true
+			}
+			seen[kis.Key] = true
+			kis.Score *= decay
+			if h.Len() < k {
+				heap.Push(h, kis)
+			} else if kis.Score > (*h)[0].Score {
+				(*h)[0] = kis
+				heap.Fix(h, 0)
+			}
+			return true
+		})
+		jm.Values = vs
+		jms = append(jms, jm)
+		return (timeBudget <= 0 || time.Since(start) <= timeBudget) && jm.Err == nil
+	})
+
+	m.stats().observeJoins(jms)
+	m.traceSlow(start, jms, h.Len(), walkErr(err, jms))
+	res = *h
+	sort.Slice(res, func(i, j int) bool { return h.Less(j, i) })
+	return
+}
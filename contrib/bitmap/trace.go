@@ -0,0 +1,197 @@
+package bitmap
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// xorFPRate is the false positive rate of 8-bit xor filters.
+const xorFPRate = 1.0 / 256
+
+// QueryTrace is a structured trace of a query spanning all ranges it visited, it
+// can be encoded as JSON.
+type QueryTrace struct {
+	Query     string       `json:"query"`
+	Start     time.Time    `json:"start"`
+	ElapsedUs int64        `json:"elapsed_us"`
+	Results   int          `json:"results"`
+	Error     string       `json:"error,omitempty"`
+	Ranges    []RangeTrace `json:"ranges"`
+}
+
+// RangeTrace contains counts of all slots of a range, see SlotTrace.
+type RangeTrace struct {
+	Start        int64       `json:"start"`
+	FastUs       int64       `json:"fast_us"`
+	ElapsedUs    int64       `json:"elapsed_us"`
+	Scans        int         `json:"scans"`
+	Hits         int         `json:"hits"`
+	FastFPRate   float64     `json:"fast_fp_rate"`
+	EstFalseHits float64     `json:"est_false_hits"`
+	Error        string      `json:"error,omitempty"`
+	Slots        []SlotTrace `json:"slots,omitempty"`
+}
+
+type SlotTrace struct {
+	Slot      int   `json:"slot"`
+	ElapsedUs int64 `json:"elapsed_us"`
+	Scans     int   `json:"scans"`
+	Hits      int   `json:"hits"`
+	// FastFPRate is the ratio of scanned entries (selected by the fast table) which
+	// are not hits.
+	FastFPRate float64 `json:"fast_fp_rate"`
+	// EstFalseHits is the expected number of hits caused by false positives of xor
+	// filters, assuming misses are true negatives.
+	EstFalseHits float64 `json:"est_false_hits"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// estimateFP estimates false hits of the scanned misses, p is the probability that
+// a miss matches because of false positives, see Query.falseMatch.
+func estimateFP(scans, hits int, p float64) (fastFPRate, estFalseHits float64) {
+	if scans > 0 {
+		fastFPRate = float64(scans-hits) / float64(scans)
+	}
+	return fastFPRate, float64(scans-hits) * p
+}
+
+// falseMatch returns the probability that q matches an entry only because xor
+// filters falsely contain its terms, which are independent with the rate xorFPRate.
+// ok is false if q can't match falsely (Not and Time), such nodes are assumed to
+// be satisfied by their parents: e.g.: AND(a, b) is about p^2 while OR(a, b) is
+// about 2p.
+func (q *Query) falseMatch() (p float64, ok bool) {
+	switch q.Op {
+	case OpTerm:
+		return xorFPRate, true
+	case OpAnd:
+		p = 1
+		for _, c := range q.Children {
+			if cp, cok := c.falseMatch(); cok {
+				p, ok = p*cp, true
+			}
+		}
+		return p, ok
+	case OpOr:
+		miss := 1.0
+		for _, c := range q.Children {
+			if cp, cok := c.falseMatch(); cok {
+				miss, ok = miss*(1-cp), true
+			}
+		}
+		return 1 - miss, ok
+	case OpAtLeast:
+		need := q.N
+		var ps, ws []float64
+		for _, c := range q.Children {
+			if cp, cok := c.falseMatch(); cok {
+				ps, ws = append(ps, cp), append(ws, c.weight())
+			} else {
+				need -= c.weight()
+			}
+		}
+		if need <= 0 || len(ps) == 0 {
+			return 0, false
+		}
+		// The least number of children to reach the threshold.
+		sort.Sort(sort.Reverse(sort.Float64Slice(ws)))
+		k := 0
+		for sum := 0.0; k < len(ws) && sum < need; k++ {
+			sum += ws[k]
+		}
+		// dp[j] is the probability that j children match falsely.
+		dp := make([]float64, len(ps)+1)
+		dp[0] = 1
+		for i, cp := range ps {
+			for j := i + 1; j > 0; j-- {
+				dp[j] = dp[j]*(1-cp) + dp[j-1]*cp
+			}
+			dp[0] *= 1 - cp
+		}
+		for _, x := range dp[k:] {
+			p += x
+		}
+		return p, true
+	}
+	return 0, false
+}
+
+// Trace converts jm into a RangeTrace, only scanned slots are included.
+func (jm JoinMetrics) Trace() RangeTrace {
+	var p float64
+	if jm.Query != nil {
+		p, _ = jm.Query.falseMatch()
+	}
+	rt := RangeTrace{
+		Start:     jm.BaseStart,
+		FastUs:    jm.FastElapsed.Microseconds(),
+		ElapsedUs: jm.Elapsed.Microseconds(),
+	}
+	if jm.Err != nil {
+		rt.Error = jm.Err.Error()
+	}
+	for i := len(jm.Slots) - 1; i >= 0; i-- {
+		s := jm.Slots[i]
+		if s.Scans == 0 && s.Err == nil {
+			continue
+		}
+		st := SlotTrace{Slot: i, ElapsedUs: s.Elapsed.Microseconds(), Scans: s.Scans, Hits: s.Hits}
+		if s.Err != nil {
+			st.Error = s.Err.Error()
+		}
+		st.FastFPRate, st.EstFalseHits = estimateFP(s.Scans, s.Hits, p)
+		rt.Slots = append(rt.Slots, st)
+		rt.Scans += s.Scans
+		rt.Hits += s.Hits
+	}
+	rt.FastFPRate, rt.EstFalseHits = estimateFP(rt.Scans, rt.Hits, p)
+	return rt
+}
+
+// NewQueryTrace creates a trace of a query started at start, which returned results
+// hits with metrics jms.
+func NewQueryTrace(start time.Time, jms []JoinMetrics, results int, err error) *QueryTrace {
+	t := &QueryTrace{
+		Start:     start,
+		ElapsedUs: time.Since(start).Microseconds(),
+		Results:   results,
+		Ranges:    make([]RangeTrace, 0, len(jms)),
+	}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	for _, jm := range jms {
+		if t.Query == "" && jm.Query != nil {
+			t.Query = jm.Query.String()
+		}
+		t.Ranges = append(t.Ranges, jm.Trace())
+	}
+	return t
+}
+
+func (t *QueryTrace) String() string {
+	buf, _ := json.Marshal(t)
+	return string(buf)
+}
+
+// walkErr returns the error which stopped a walk, either err of the walk itself
+// or the error of the last join.
+func walkErr(err error, jms []JoinMetrics) error {
+	if err == io.EOF {
+		err = nil
+	}
+	if err == nil && len(jms) > 0 {
+		err = jms[len(jms)-1].Err
+	}
+	return err
+}
+
+// traceSlow reports queries taking longer than SlowQueryThreshold to Event.OnSlowQuery.
+func (m *Manager) traceSlow(start time.Time, jms []JoinMetrics, results int, err error) {
+	if m.Event.OnSlowQuery == nil || time.Since(start) < m.SlowQueryThreshold {
+		return
+	}
+	m.Event.OnSlowQuery(NewQueryTrace(start, jms, results, err))
+}
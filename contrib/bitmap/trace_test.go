@@ -0,0 +1,93 @@
+package bitmap
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryTrace(t *testing.T) {
+	m, err := NewManager(t.TempDir(), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	fillManager(t, m, 0, 20, func(i int) []uint64 { return []uint64{1, uint64(i % 2)} })
+
+	var traces []*QueryTrace
+	m.Event.OnSlowQuery = func(t *QueryTrace) { traces = append(traces, t) }
+	m.SlowQueryThreshold = time.Hour
+	m.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+	if len(traces) != 0 {
+		t.Fatal(traces)
+	}
+
+	m.SlowQueryThreshold = 0
+	res, _ := m.CollectSimple(distinct{}, Values{Exact: []uint64{1, 0}}, 100)
+	if len(traces) != 1 || len(res) != 10 {
+		t.Fatal(traces, len(res))
+	}
+
+	var tr QueryTrace
+	if err := json.Unmarshal([]byte(traces[0].String()), &tr); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Results != 10 || len(tr.Ranges) != 2 || tr.Query == "" {
+		t.Fatal(traces[0])
+	}
+	for _, r := range tr.Ranges {
+		if r.Hits != 5 || r.Scans < r.Hits || len(r.Slots) != 1 || r.Slots[0].Slot != 0 || r.Slots[0].Hits != 5 {
+			t.Fatal(traces[0])
+		}
+		if r.FastFPRate != float64(r.Scans-5)/float64(r.Scans) || r.EstFalseHits < 0 {
+			t.Fatal(traces[0])
+		}
+	}
+}
+
+func TestFalseMatch(t *testing.T) {
+	const p = xorFPRate
+	a, b, c := QueryTerm(1), QueryTerm(2), QueryTerm(3)
+	for _, tc := range []struct {
+		q  *Query
+		p  float64
+		ok bool
+	}{
+		{a, p, true},
+		{QueryAnd(a, b), p * p, true},
+		{QueryOr(a, b), 1 - (1-p)*(1-p), true},
+		{QueryAnd(a, QueryNot(b), QueryTime(0, 1)), p, true},
+		{QueryAtLeast(2, a, b, c), 3*p*p*(1-p) + p*p*p, true},
+		{QueryAtLeast(1, a, QueryNot(b)), 0, false},
+		{QueryNot(a), 0, false},
+	} {
+		if x, ok := tc.q.falseMatch(); ok != tc.ok || math.Abs(x-tc.p) > 1e-12 {
+			t.Fatal(tc.q, x, ok, tc.p)
+		}
+	}
+}
+
+func TestQueryTraceError(t *testing.T) {
+	m, err := NewManager(t.TempDir(), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	fillManager(t, m, 0, 20, nil)
+
+	var traces []*QueryTrace
+	m.Event.OnSlowQuery = func(t *QueryTrace) { traces = append(traces, t) }
+	vs := Values{Major: []uint64{1}, Weights: map[uint64]float64{1: -1}}
+	m.Search(vs, time.Time{}, time.Time{}, 10, nil)
+	m.CollectTopK(vs, 10, 0)
+	if len(traces) != 2 {
+		t.Fatal(traces)
+	}
+	for _, tr := range traces {
+		if !strings.Contains(tr.Error, "negative weight") || len(tr.Ranges) != 1 {
+			t.Fatal(tr)
+		}
+	}
+}
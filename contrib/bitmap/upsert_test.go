@@ -0,0 +1,139 @@
+package bitmap
+
+import (
+	"testing"
+)
+
+func TestUpsert(t *testing.T) {
+	b := New(0)
+	b.Add(Uint64Key(1), []uint64{1})
+	b.Add(Uint64Key(2), []uint64{1})
+	b.Add(Uint64Key(1), []uint64{1, 2})
+	if !b.Upsert(Uint64Key(1), []uint64{1, 3}) {
+		t.Fatal("upsert")
+	}
+	var res []KeyIdScore
+	b.Join(Values{Exact: []uint64{1}}, -1, true, func(kis KeyIdScore) bool {
+		res = append(res, kis)
+		return true
+	})
+	if len(res) != 2 || res[0].Id != 3 || res[1].Id != 1 {
+		t.Fatal(res)
+	}
+
+	// Upserts are logged.
+	w, err := OpenWALFrom(NewMemStorage(), "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.append(0, []*aggTask{
+		{key: Uint64Key(1), values: []uint64{1}},
+		{key: Uint64Key(1), values: []uint64{2}, upsert: true},
+	})
+	b = New(0)
+	if n, err := w.Replay(b); n != 2 || err != nil || !b.Contains(Uint64Key(1)) {
+		t.Fatal(n, err)
+	}
+	if id, _ := b.Find(Uint64Key(1)); id != 1 {
+		t.Fatal(id)
+	}
+}
+
+func TestManagerUpsert(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewManager(dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillManager(t, m, 0, 3, func(int) []uint64 { return []uint64{1, 100} })
+
+	count := func(m *Manager, v uint64) int {
+		res, _ := m.CollectSimple(distinct{}, Values{Exact: []uint64{v}}, 100)
+		return len(res)
+	}
+	if err := m.Saver().Upsert(Uint64Key(1), []uint64{1, 101}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Saver().Upsert(Uint64Key(5), []uint64{1, 101}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Saver().Upsert(Uint64Key(5), []uint64{1, 102}); err != nil {
+		t.Fatal(err)
+	}
+	if a, b, c, d := count(m, 1), count(m, 100), count(m, 101), count(m, 102); a != 4 || b != 2 || c != 1 || d != 1 {
+		t.Fatal(a, b, c, d)
+	}
+	m.Close()
+
+	// Upserts in the current range are replayed from the WAL.
+	m, err = NewManager(dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if a, b, c, d := count(m, 1), count(m, 100), count(m, 101), count(m, 102); a != 4 || b != 2 || c != 1 || d != 1 {
+		t.Fatal(a, b, c, d)
+	}
+}
+
+func TestManagerUpsertOlder(t *testing.T) {
+	s := NewMemStorage()
+	m, err := NewStorageManager(s, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys are in both ranges.
+	starts := append(fillManager(t, m, 0, 3, nil), fillManager(t, m, 0, 3, nil)...)
+	first := m.getName(starts[0])
+	r, _ := s.Open(first)
+	data := make([]byte, r.Size())
+	r.ReadAt(data, 0)
+	r.Close()
+
+	count := func(m *Manager) int {
+		res, _ := m.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+		return len(res)
+	}
+	// The first batch is checkpointed, so the upsert is only in the WAL.
+	fillManager(t, m, 10, 11, nil)
+	if err := m.Saver().Upsert(Uint64Key(0), []uint64{1}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(m); n != 6 {
+		t.Fatal(n)
+	}
+
+	// Crash before the tombstone of the oldest range is saved, it is redone by
+	// replaying the WAL of the current range.
+	w, _ := s.Create(first)
+	w.Write(data)
+	w.Close()
+	m, err = NewStorageManager(s, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if n := count(m); n != 6 {
+		t.Fatal(n)
+	}
+}
+
+func TestManagerUpsertRanges(t *testing.T) {
+	m, err := NewStorageManager(NewMemStorage(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.UpsertRanges = 2
+	for i := 0; i < 4; i++ {
+		fillManager(t, m, 0, 1, nil)
+	}
+	if err := m.Saver().Upsert(Uint64Key(0), []uint64{1}); err != nil {
+		t.Fatal(err)
+	}
+	// Entries of the 2 oldest ranges are beyond UpsertRanges.
+	res, _ := m.CollectSimple(distinct{}, Values{Exact: []uint64{1}}, 100)
+	if len(res) != 3 {
+		t.Fatal(res)
+	}
+}
@@ -2,10 +2,12 @@ package bitmap
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math/bits"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/coyove/sdss/contrib/clock"
@@ -15,6 +17,25 @@ type Values struct {
 	Oneof []uint64
 	Major []uint64
 	Exact []uint64
+
+	// Exclude rejects entries containing any of these values. Membership is tested
+	// by xor filters which have false positives, so an entry may be over-excluded
+	// when one of its filters falsely reports an excluded value.
+	Exclude []uint64
+
+	// Weights of Major values (e.g.: IDF), missing values weigh 1. The score of an
+	// entry is the sum of weights of its matched Major values. Joins fail with JoinMetrics.Err
+	// if any weight is negative.
+	Weights map[uint64]float64
+
+	// MinScore is the minimum sum of weights of matched Major values. If not set,
+	// the threshold is derived from the number of Major values, see majorScore.
+	MinScore float64
+
+	// Explain makes joins report matched values in KeyIdScore.Terms by their indices
+	// in Terms(), and in KeyIdScore.Matched if values are stored. Without stored
+	// values, matches are tested by xor filters and may contain false positives.
+	Explain bool
 }
 
 type meterWriter struct {
@@ -80,7 +101,26 @@ func combinehash(k1, seed uint32) uint32 {
 type KeyIdScore struct {
 	Key   Key
 	Id    int64
-	Score int
+	Score float64
+	Time  int64 // unix milli timestamp provided by Range.AddAt, 0 if unknown
+	Start int64 // start of the range containing the entry
+
+	// Matched contains scored query terms found in stored values of the entry, only
+	// set in explain mode and nil if values are not stored, see Range.EnableStoredValues.
+	Matched []uint64
+
+	// Terms contains indices of matched scored query terms, only set in explain
+	// mode, see Values.Explain.
+	Terms TermSet
+}
+
+// before reports whether k was added before k2, entries are ordered by starts of
+// their ranges, then by their offsets in ranges. Ids are not comparable across ranges.
+func (k KeyIdScore) before(k2 KeyIdScore) bool {
+	if k.Start != k2.Start {
+		return k.Start < k2.Start
+	}
+	return k.Id < k2.Id
 }
 
 type JoinMetrics struct {
@@ -88,12 +128,17 @@ type JoinMetrics struct {
 	Start       int64
 	Desc        bool
 	Values      Values
+	Query       *Query
 	FastElapsed time.Duration
 	Elapsed     time.Duration
-	Slots       [slotNum]struct {
-		Scans, Hits int
-		Elapsed     time.Duration
-	}
+	Err         error // the reason why the join was interrupted, e.g.: context.Canceled
+	Slots       []SlotMetrics
+}
+
+type SlotMetrics struct {
+	Scans, Hits int
+	Elapsed     time.Duration
+	Err         error
 }
 
 func (jm JoinMetrics) String() string {
@@ -103,9 +148,13 @@ func (jm JoinMetrics) String() string {
 	}
 	x := fmt.Sprintf("join map [%d] start at %d (%s) in %vus",
 		jm.BaseStart, jm.Start, dir, jm.Elapsed.Microseconds())
-	x += fmt.Sprintf("\n\tinput: oneof=%d, major=%d (min=%d), exact=%d",
-		len(jm.Values.Oneof), len(jm.Values.Major), jm.Values.majorScore(), len(jm.Values.Exact))
+	x += fmt.Sprintf("\n\tinput: oneof=%d, major=%d (min=%.2f), exact=%d, exclude=%d",
+		len(jm.Values.Oneof), len(jm.Values.Major), jm.Values.majorScore(), len(jm.Values.Exact), len(jm.Values.Exclude))
+	x += fmt.Sprintf("\n\tquery: %v", jm.Query)
 	x += fmt.Sprintf("\n\tfast lookup: %vus", jm.FastElapsed.Microseconds())
+	if jm.Err != nil {
+		x += fmt.Sprintf("\n\tinterrupted: %v", jm.Err)
+	}
 
 	c := 0
 	for i := len(jm.Slots) - 1; i >= 0; i-- {
@@ -118,6 +167,9 @@ func (jm JoinMetrics) String() string {
 			}
 			c++
 		}
+		if s.Err != nil {
+			x += fmt.Sprintf("\n\tsubrange [%02d]: %v", i, s.Err)
+		}
 	}
 	if c == 0 {
 		x += " (NO HITS)"
@@ -126,27 +178,113 @@ func (jm JoinMetrics) String() string {
 }
 
 func (b *Range) Save(path string, compress bool) (int, error) {
+	return b.SaveTo(Dir(filepath.Dir(path)), filepath.Base(path), compress)
+}
+
+func (b *Range) SaveTo(s Storage, name string, compress bool) (int, error) {
 	b.mfmu.Lock()
 	defer b.mfmu.Unlock()
+	return b.save(s, name, compress)
+}
 
-	bakpath := fmt.Sprintf("%s.%d.mtfbak", path, clock.Unix())
+func (b *Range) save(s Storage, name string, compress bool) (int, error) {
+	bakname := fmt.Sprintf("%s.%d.mtfbak", name, clock.Unix())
 
-	f, err := os.Create(bakpath)
+	w, err := s.Create(bakname)
 	if err != nil {
 		return 0, err
 	}
-	sz, err := b.Marshal(f, compress)
-	f.Close()
+
+	// Changes made after this point will be tracked for SaveIncremental, they may
+	// be saved twice, which is harmless.
+	b.segmu.Lock()
+	b.seg.track = true
+	fastN, deadN := len(b.seg.fast), len(b.seg.dead)
+	b.segmu.Unlock()
+
+	b.mu.RLock()
+	end := b.end
+	sz, err := b.marshalIndexed(w, compress)
+	b.mu.RUnlock()
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	if err := os.Remove(path); err != nil {
-		if !os.IsNotExist(err) {
+	if err := s.Remove(name); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
 			return 0, err
 		}
 	}
-	return sz, os.Rename(bakpath, path)
+	if err := s.Rename(bakname, name); err != nil {
+		return 0, err
+	}
+
+	b.segmu.Lock()
+	b.seg.store, b.seg.name = s, name
+	b.seg.base, b.seg.size, b.seg.end, b.seg.count = int64(sz), int64(sz), end, 0
+	b.seg.fast = append([]uint32{}, b.seg.fast[fastN:]...)
+	b.seg.dead = append([]int64{}, b.seg.dead[deadN:]...)
+	b.segmu.Unlock()
+	return sz, nil
+}
+
+// Open opens the range file at path, see OpenFrom.
+func Open(path string) (*Range, error) {
+	return OpenFrom(Dir(filepath.Dir(path)), filepath.Base(path))
+}
+
+// OpenFrom opens the range file name in s, files in indexed layout will be decoded
+// lazily and memory mapped if s supports (e.g.: Dir), other files will be fully
+// loaded like Load. It returns nil if name doesn't exist.
+func OpenFrom(s Storage, name string) (*Range, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	var buf []byte
+	var mf *mmapFile
+	if rm, ok := r.(interface{ mmap() (*mmapFile, error) }); ok {
+		if mf, err = rm.mmap(); err != nil {
+			return nil, err
+		}
+		buf = mf.data
+	} else {
+		buf = make([]byte, r.Size())
+		if n, err := r.ReadAt(buf, 0); n < len(buf) {
+			return nil, err
+		}
+	}
+
+	if len(buf) == 0 || buf[0]&fmtFlag == 0 || buf[0]&fmtIndexed == 0 {
+		b, err := Unmarshal(bytes.NewReader(buf))
+		if mf != nil {
+			mf.close()
+		}
+		return b, err
+	}
+	if _, _, err := parseVersion(buf[0]); err != nil {
+		if mf != nil {
+			mf.close()
+		}
+		return nil, err
+	}
+	b, err := parseIndexed(buf, mf)
+	if err != nil {
+		if mf != nil {
+			mf.close()
+		}
+		return nil, err
+	}
+	b.seg.loaded(s, name)
+	return b, nil
 }
 
 func Load(path string) (*Range, error) {
@@ -158,7 +296,12 @@ func Load(path string) (*Range, error) {
 		return nil, err
 	}
 	defer f.Close()
-	return Unmarshal(f)
+	b, err := Unmarshal(f)
+	if err != nil {
+		return nil, err
+	}
+	b.seg.loaded(Dir(filepath.Dir(path)), filepath.Base(path))
+	return b, nil
 }
 
 type bitmap1024 [fastSlotNum / 64]uint64
@@ -167,10 +310,29 @@ func (b *bitmap1024) add(index uint16) { // [0, fastSlotNum)
 	(*b)[index/64] |= 1 << (index % 64)
 }
 
+func (b *bitmap1024) remove(index uint16) {
+	(*b)[index/64] &^= 1 << (index % 64)
+}
+
 func (b *bitmap1024) contains(index uint16) bool {
 	return (*b)[index/64]&(1<<(index%64)) > 0
 }
 
+// any returns whether any of [lo, hi) is set.
+func (b *bitmap1024) any(lo, hi int) bool {
+	for i := lo; i < hi; {
+		w, n := (*b)[i/64]>>(i%64), 64-i%64
+		if hi-i < n {
+			w, n = w&(1<<(hi-i)-1), hi-i
+		}
+		if w != 0 {
+			return true
+		}
+		i += n
+	}
+	return false
+}
+
 func (b *bitmap1024) iterate(f func(uint16) bool) {
 	for si, s := range *b {
 		for i := 0; i < 64; i++ {
@@ -189,6 +351,15 @@ func (b *bitmap1024) and(b2 *bitmap1024) {
 	}
 }
 
+func (b *bitmap1024) intersects(b2 *bitmap1024) bool {
+	for i := range *b {
+		if (*b)[i]&(*b2)[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *bitmap1024) or(b2 *bitmap1024) {
 	for i := range *b {
 		(*b)[i] |= (*b2)[i]
@@ -206,15 +377,35 @@ func (b bitmap1024) String() string {
 	return buf.String()
 }
 
-func (vs *Values) majorScore() int {
+func (vs *Values) weight(v uint64) float64 {
+	if w, ok := vs.Weights[v]; ok {
+		return w
+	}
+	return 1
+}
+
+// majorScore returns MinScore if set, otherwise the minimum number of Major values
+// to match: all of them if <= 2, all but one if <= 4 and 80% for the rest. When weights
+// are provided, the threshold becomes the same fraction of the total weight.
+func (vs *Values) majorScore() float64 {
+	if vs.MinScore > 0 {
+		return vs.MinScore
+	}
 	s := len(vs.Major)
+	n := s * 4 / 5
 	if s <= 2 {
-		return s
+		n = s
+	} else if s <= 4 {
+		n = s - 1
+	}
+	if len(vs.Weights) == 0 || s == 0 {
+		return float64(n)
 	}
-	if s <= 4 {
-		return s - 1
+	total := 0.0
+	for _, v := range vs.Major {
+		total += vs.weight(v)
 	}
-	return s * 4 / 5
+	return total * float64(n) / float64(s)
 }
 
 func (v *Values) Clean() {
@@ -237,8 +428,10 @@ func (v *Values) Clean() {
 	add(v.Oneof, 'o')
 	add(v.Major, 'm')
 	add(v.Exact, 'e')
+	add(v.Exclude, 'x')
 
 	v.Oneof = remove(v.Oneof, 'o')
 	v.Major = remove(v.Major, 'm')
 	v.Exact = remove(v.Exact, 'e')
+	v.Exclude = remove(v.Exclude, 'x')
 }
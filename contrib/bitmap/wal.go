@@ -0,0 +1,217 @@
+package bitmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// WAL is an append-only log of batches added to a range since its last checkpoint.
+// Each record is:
+//
+//	size(4) checksum(4) firstId(8) count(4) entries
+//
+// And each entry is:
+//
+//	key(16) ts(8) valuesLen(4) values(valuesLen*8)
+//
+// The highest bit of valuesLen is set for upserts.
+//
+// firstId is the id assigned to the first entry of the batch, entries already
+// in the range are skipped during replay, so replaying is idempotent.
+type WAL struct {
+	mu     sync.Mutex
+	f      StorageFile
+	size   int64
+	remove func() error
+}
+
+func OpenWAL(path string) (*WAL, error) {
+	return OpenWALFrom(Dir(filepath.Dir(path)), filepath.Base(path))
+}
+
+func OpenWALFrom(s FileStorage, name string) (*WAL, error) {
+	f, size, err := s.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &WAL{f: f, size: size, remove: func() error { return s.Remove(name) }}, nil
+}
+
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// encodeRecord encodes a batch as a record, prefix will be placed before firstId
+// and covered by the checksum.
+func encodeRecord(prefix []byte, firstId int64, tasks []*aggTask) []byte {
+	p := &bytes.Buffer{}
+	p.Write(make([]byte, 8))
+	p.Write(prefix)
+	binary.Write(p, binary.BigEndian, firstId)
+	binary.Write(p, binary.BigEndian, uint32(len(tasks)))
+	for _, t := range tasks {
+		p.Write(t.key[:])
+		binary.Write(p, binary.BigEndian, t.ts)
+		n := uint32(len(t.values))
+		if t.upsert {
+			n |= upsertFlag
+		}
+		binary.Write(p, binary.BigEndian, n)
+		binary.Write(p, binary.BigEndian, t.values)
+	}
+	buf := p.Bytes()
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-8))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[8:]))
+	return buf
+}
+
+// readRecord reads a record and returns its payload (after the checksum).
+func readRecord(rd io.Reader) ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, fmt.Errorf("record checksum mismatch")
+	}
+	return buf, nil
+}
+
+func (w *WAL) append(firstId int64, tasks []*aggTask) error {
+	buf := encodeRecord(nil, firstId, tasks)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.f.WriteAt(buf, w.size); err != nil {
+		w.f.Truncate(w.size)
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Truncate(w.size)
+		return err
+	}
+	w.size += int64(len(buf))
+	return nil
+}
+
+// Replay adds all logged entries which are not in b yet. A torn record at the end
+// of the log (e.g.: crashed during writing) is discarded.
+func (w *WAL) Replay(b *Range) (n int, err error) {
+	n, _, err = w.replay(b)
+	return n, err
+}
+
+// replay is Replay but also returns keys of all logged upserts, including those
+// already in b, whose tombstones in older ranges may be lost.
+func (w *WAL) replay(b *Range) (n int, upserts []Key, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	rd := bufio.NewReader(io.NewSectionReader(w.f, 0, w.size))
+	var good int64
+	for {
+		buf, err := readRecord(rd)
+		if err != nil {
+			break
+		}
+		x, err := replayRecord(b, buf, func(k Key) { upserts = append(upserts, k) })
+		n += x
+		if err != nil {
+			return n, upserts, fmt.Errorf("replay record at %d: %v", good, err)
+		}
+		good += int64(8 + len(buf))
+	}
+
+	if good < w.size {
+		if err := w.f.Truncate(good); err != nil {
+			return n, upserts, err
+		}
+		w.size = good
+	}
+	return n, upserts, nil
+}
+
+// replayRecord adds entries of the record which are not in b yet, onUpsert (can be
+// nil) is called with keys of all upserts in the record.
+func replayRecord(b *Range, buf []byte, onUpsert func(Key)) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid record: %v", r)
+		}
+	}()
+
+	id := int64(binary.BigEndian.Uint64(buf))
+	count := int(binary.BigEndian.Uint32(buf[8:]))
+	buf = buf[12:]
+	for i := 0; i < count; i, id = i+1, id+1 {
+		key := BytesKey(buf[:KeySize])
+		ts := int64(binary.BigEndian.Uint64(buf[KeySize:]))
+		vn := binary.BigEndian.Uint32(buf[KeySize+8:])
+		values := make([]uint64, vn&^upsertFlag)
+		buf = buf[KeySize+12:]
+		for j := range values {
+			values[j] = binary.BigEndian.Uint64(buf[j*8:])
+		}
+		buf = buf[len(values)*8:]
+
+		if vn&upsertFlag != 0 && onUpsert != nil {
+			onUpsert(key)
+		}
+		if id < b.Len() {
+			continue
+		}
+		if id > b.Len() {
+			return n, fmt.Errorf("missing entries between %d and %d", b.Len(), id)
+		}
+		if vn&upsertFlag != 0 {
+			if !b.UpsertAt(key, values, ts) {
+				return n, ErrBitmapFull
+			}
+		} else if !b.AddAt(key, values, ts) {
+			return n, ErrBitmapFull
+		}
+		n++
+	}
+	return n, nil
+}
+
+const upsertFlag = 1 << 31
+
+// Truncate clears the log, it should be called after the range is checkpointed.
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	return w.f.Sync()
+}
+
+// Close closes the log, the file will be removed if it is empty.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if w.size == 0 {
+		return w.remove()
+	}
+	return nil
+}